@@ -1,34 +1,184 @@
 $(function() {
   var addBtn    = $("#add-btn")
   var appSelect = $("#repo-app")
-  var modal     = $(".modal")
-  var tableBody = $("table tbody")
-  var alertBox  = $(".alert")
-  var template  = _.template($("#row-template").html())
-  var option    = _.template($("#option-template").html())
+  var modal        = $("#add-modal")
+  var form         = modal.find("form")
+  var historyModal = $("#history-modal")
+  var tableBody    = $("#repos tbody")
+  var deploysBody  = $("#deploys tbody")
+  var previewsBody = $("#previews tbody")
+  var historyBody  = historyModal.find("tbody")
+  var logModal     = $("#log-modal")
+  var logOutput    = logModal.find("pre")
+  var alertBox     = $(".alert")
+  var template     = _.template($("#row-template").html())
+  var option       = _.template($("#option-template").html())
+  var deployRow    = _.template($("#deploy-template").html())
+  var previewRow   = _.template($("#preview-template").html())
+
+  var renderDeploy = function(deploy, showRepo) {
+    return deployRow(_.extend({ exit_status: undefined, error: null, skip_reason: "", tag: "", showRepo: showRepo }, deploy))
+  }
+
+  // requests which change state must include the CSRF token
+  $.ajaxSetup({ headers: { "X-CSRF-Token": $("meta[name=csrf-token]").attr("content") } })
 
   $(document).ajaxError(function(event, jqxhr, settings, error) {
     var msg = settings.type + " " + settings.url + " Error!"
+    if(jqxhr.responseText)
+      msg += " " + jqxhr.responseText
 
     alertBox.removeClass("hide").find("p").text(msg)
   })
 
-  $.getJSON("/repos.json", function(repos) {
-    _.each(repos, function(repo) {
+  var repos = {}
+
+  $.getJSON("/repos.json", function(list) {
+    _.each(list, function(repo) {
+      repos[repo.id] = repo
       repo.created_at = moment(repo.created_at)
+      repo.tag_pattern = repo.tag_pattern || ""
+      repo.include_paths = repo.include_paths || []
+      repo.exclude_paths = repo.exclude_paths || []
+      repo.orphaned_apps = repo.orphaned_apps || []
       tableBody.append(template(repo))
     })
   })
 
-  addBtn.click(function(e) {
+  $.getJSON("/previews.json", function(previews) {
+    _.each(previews, function(preview) {
+      previewsBody.append(previewRow(_.extend({ domain: "" }, preview)))
+    })
+  })
+
+  $.getJSON("/deploys.json", function(deploys) {
+    _.each(deploys, function(deploy) {
+      deploysBody.append(renderDeploy(deploy, true))
+    })
+  })
+
+  tableBody.on("click", ".history-btn", function(e) {
+    e.preventDefault()
+    historyBody.empty()
+    historyModal.modal()
+    $.getJSON("/repos/" + $(this).data("id") + "/deploys.json", function(deploys) {
+      _.each(deploys, function(deploy) {
+        historyBody.append(renderDeploy(deploy, false))
+      })
+    })
+  })
+
+  var logSource = null
+
+  var closeLogSource = function() {
+    if(logSource) {
+      logSource.close()
+      logSource = null
+    }
+  }
+
+  logModal.on("hidden.bs.modal", closeLogSource)
+
+  $(document).on("click", ".log-btn", function(e) {
     e.preventDefault()
+    closeLogSource()
+    logOutput.empty()
+    logModal.modal()
+
+    // the server replays stored lines before streaming new ones, and sends
+    // the deploy once it has finished
+    logSource = new EventSource("/deploys/" + $(this).data("id") + "/log?follow=true")
+    logSource.onmessage = function(e) {
+      var event = JSON.parse(e.data)
+      if(event.line) {
+        logOutput.append($("<span>").toggleClass("text-danger", event.line.stream == "stderr").text(event.line.data + "\n"))
+        logOutput.scrollTop(logOutput.prop("scrollHeight"))
+      }
+      if(event.deploy) {
+        closeLogSource()
+        logOutput.append($("<strong>").text("deploy " + event.deploy.state + "\n"))
+      }
+    }
+  })
+
+  // showForm shows the repo form, filled in with the given repo when
+  // editing an existing one
+  var showForm = function(repo) {
+    form[0].reset()
+    form.data("id", repo ? repo.id : null)
+    $("#add-modal-title").text(repo ? "Edit Repo" : "Add Repo")
+    $("#add-modal-submit").text(repo ? "Save" : "Create")
+    $("#repo-secret-group").toggle(!repo)
+    if(repo) {
+      $("#repo-provider").val(repo.provider)
+      $("#repo-name").val(repo.name)
+      $("#repo-branch").val(repo.tag_pattern ? "" : repo.branch)
+      $("#repo-tag-pattern").val(repo.tag_pattern)
+      $("#repo-include-paths").val(repo.include_paths.join("\n"))
+      $("#repo-exclude-paths").val(repo.exclude_paths.join("\n"))
+      $("#repo-preview-template").val(repo.preview_template || "")
+    }
     modal.removeClass("hide").modal()
+    appSelect.empty()
     $.getJSON("/apps.json", function(apps) {
       _.each(apps, function(app) {
         if(app.meta && app.meta["flynn-system-app"] == "true")
           return
         appSelect.append(option(app))
       })
+      if(repo)
+        appSelect.val(repo.apps)
+    })
+  }
+
+  var lines = function(val) {
+    return _.compact(_.map(val.split("\n"), function(line) { return line.trim() }))
+  }
+
+  addBtn.click(function(e) {
+    e.preventDefault()
+    showForm(null)
+  })
+
+  tableBody.on("click", ".edit-btn", function(e) {
+    e.preventDefault()
+    showForm(repos[$(this).data("id")])
+  })
+
+  // existing repos are updated using the JSON API rather than posting the
+  // form
+  form.submit(function(e) {
+    var id = form.data("id")
+    if(!id)
+      return
+    e.preventDefault()
+    $.ajax({
+      type:        "PUT",
+      url:         "/repos/" + id,
+      contentType: "application/json",
+      data: JSON.stringify({
+        provider:         $("#repo-provider").val(),
+        name:             $("#repo-name").val(),
+        branch:           $("#repo-branch").val(),
+        tag_pattern:      $("#repo-tag-pattern").val(),
+        apps:             appSelect.val() || [],
+        include_paths:    lines($("#repo-include-paths").val()),
+        exclude_paths:    lines($("#repo-exclude-paths").val()),
+        preview_template: $("#repo-preview-template").val()
+      }),
+      success: function() { window.location.reload() }
+    })
+  })
+
+  tableBody.on("click", ".delete-btn", function(e) {
+    e.preventDefault()
+    var repo = repos[$(this).data("id")]
+    if(!confirm("Delete " + repo.name + " (" + (repo.tag_pattern ? "tags: " + repo.tag_pattern : repo.branch) + ")?"))
+      return
+    $.ajax({
+      type:    "DELETE",
+      url:     "/repos/" + repo.id,
+      success: function() { window.location.reload() }
     })
   })
 })
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn/pkg/postgres"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Audited actions.
+const (
+	AuditRepoCreate     = "repo.create"
+	AuditRepoUpdate     = "repo.update"
+	AuditRepoDelete     = "repo.delete"
+	AuditRepoSecret     = "repo.secret"
+	AuditDeployTrigger  = "deploy.trigger"
+	AuditDeployRollback = "deploy.rollback"
+	AuditDeliveryReplay = "delivery.replay"
+	AuditTokenCreate    = "token.create"
+	AuditTokenRevoke    = "token.revoke"
+	AuditUserCreate     = "user.create"
+	AuditUserDelete     = "user.delete"
+	AuditTeamCreate     = "team.create"
+	AuditTeamUpdate     = "team.update"
+	AuditTeamDelete     = "team.delete"
+	AuditRoleCreate     = "role.create"
+	AuditRoleDelete     = "role.delete"
+)
+
+// configActor is the actor of changes made by syncing REPO_CONFIG.
+const configActor = "REPO_CONFIG"
+
+// auditEventLimit is the maximum number of audit events returned by
+// GET /audit.json.
+const auditEventLimit = 1000
+
+// AuditEvent records who changed the configuration or triggered a deploy,
+// and is never updated or deleted once recorded.
+type AuditEvent struct {
+	ID        int64       `json:"id"`
+	Action    string      `json:"action"`
+	Actor     string      `json:"actor"`
+	UserID    *int32      `json:"user_id,omitempty"`
+	TokenID   *int32      `json:"token_id,omitempty"`
+	IP        string      `json:"ip,omitempty"`
+	Apps      []string    `json:"apps"`
+	RepoID    *int32      `json:"repo_id,omitempty"`
+	Details   interface{} `json:"details"`
+	CreatedAt *time.Time  `json:"created_at"`
+}
+
+const auditEventColumns = "id, action, actor, user_id, token_id, ip, apps, repo_id, details, created_at"
+
+const insertAuditEvent = "INSERT INTO audit_events (action, actor, user_id, token_id, ip, apps, repo_id, details) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)"
+
+func scanAuditEvent(s postgres.Scanner) (*AuditEvent, error) {
+	e := &AuditEvent{}
+	return e, s.Scan(&e.ID, &e.Action, &e.Actor, &e.UserID, &e.TokenID, &e.IP, &e.Apps, &e.RepoID, &e.Details, &e.CreatedAt)
+}
+
+// insertArgs returns the arguments for the insertAuditEvent query.
+func (e *AuditEvent) insertArgs() []interface{} {
+	if e.Apps == nil {
+		e.Apps = []string{}
+	}
+	if e.Details == nil {
+		e.Details = map[string]interface{}{}
+	}
+	return []interface{}{e.Action, e.Actor, e.UserID, e.TokenID, e.IP, e.Apps, e.RepoID, e.Details}
+}
+
+// audit records the event as having been made by the caller of the
+// request, in the transaction which made the change so that the change is
+// rolled back if the event cannot be recorded.
+func (s *Server) audit(tx *postgres.DBTx, req *http.Request, e *AuditEvent) error {
+	caller := requestCaller(req)
+	switch {
+	case caller.Token != nil:
+		e.Actor = "token:" + caller.Token.Name
+		e.TokenID = &caller.Token.ID
+		e.UserID = caller.Token.UserID
+	case caller.User != nil:
+		e.Actor = caller.User.Username
+		e.UserID = &caller.User.ID
+	default:
+		e.Actor = "anonymous"
+	}
+	e.IP = s.remoteIP(req)
+	return tx.Exec(insertAuditEvent, e.insertArgs()...)
+}
+
+// commitAudited records the event in the transaction which made the change
+// and commits it, responding with a 500 error with the message if either
+// fails.
+func (s *Server) commitAudited(w http.ResponseWriter, req *http.Request, tx *postgres.DBTx, e *AuditEvent, msg string) bool {
+	if err := s.audit(tx, req, e); err != nil {
+		log.Printf("error recording %s audit event: %s\n", e.Action, err)
+		http.Error(w, msg, 500)
+		return false
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println("error committing db transaction:", err)
+		http.Error(w, msg, 500)
+		return false
+	}
+	return true
+}
+
+// repoAuditEvent returns the event for an action on a repo.
+func repoAuditEvent(action string, repo *Repo) *AuditEvent {
+	return &AuditEvent{
+		Action:  action,
+		Apps:    repo.Apps,
+		RepoID:  &repo.ID,
+		Details: map[string]interface{}{"repo": repo},
+	}
+}
+
+// remoteIP returns the IP address of the client, which is the last address
+// in X-Forwarded-For when behind the Flynn router since any earlier ones
+// were set by the client. X-Forwarded-For is ignored otherwise since it
+// could have been set by the client.
+func (s *Server) remoteIP(req *http.Request) string {
+	if fwd := req.Header["X-Forwarded-For"]; s.behindRouter && len(fwd) > 0 {
+		addrs := strings.Split(strings.Join(fwd, ","), ",")
+		return strings.TrimSpace(addrs[len(addrs)-1])
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// getAuditEvents returns the most recent audit events, optionally filtered
+// by the actor, action and app query parameters, and by the time range
+// given by the since and until query parameters (formatted as RFC 3339).
+func (s *Server) getAuditEvents(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var since, until *time.Time
+	for name, t := range map[string]**time.Time{"since": &since, "until": &until} {
+		if v := req.FormValue(name); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid %s time: %s", name, err), 400)
+				return
+			}
+			*t = &parsed
+		}
+	}
+	rows, err := s.db.Query(
+		fmt.Sprintf(`SELECT %s FROM audit_events
+		 WHERE ($1 = '' OR actor = $1) AND ($2 = '' OR action = $2) AND ($3 = '' OR $3 = ANY(apps))
+		 AND ($4::timestamptz IS NULL OR created_at >= $4) AND ($5::timestamptz IS NULL OR created_at < $5)
+		 ORDER BY id DESC LIMIT %d`, auditEventColumns, auditEventLimit),
+		req.FormValue("actor"), req.FormValue("action"), req.FormValue("app"), since, until,
+	)
+	if err != nil {
+		log.Println("error getting audit events from db:", err)
+		http.Error(w, "error getting audit events", 500)
+		return
+	}
+	events := []*AuditEvent{}
+	for rows.Next() {
+		event, err := scanAuditEvent(rows)
+		if err != nil {
+			rows.Close()
+			log.Println("error scanning db row:", err)
+			http.Error(w, "error getting audit events", 500)
+			return
+		}
+		events = append(events, event)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("error scanning db rows:", err)
+		http.Error(w, "error getting audit events", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestRemoteIP(t *testing.T) {
+	for _, test := range []struct {
+		remoteAddr   string
+		forwarded    []string
+		behindRouter bool
+		ip           string
+	}{
+		{remoteAddr: "10.0.0.1:5000", ip: "10.0.0.1"},
+		{remoteAddr: "[::1]:5000", ip: "::1"},
+		{remoteAddr: "10.0.0.1:5000", forwarded: []string{"1.2.3.4"}, ip: "10.0.0.1"},
+		{remoteAddr: "10.0.0.1:5000", forwarded: []string{"1.2.3.4"}, behindRouter: true, ip: "1.2.3.4"},
+		{remoteAddr: "10.0.0.1:5000", forwarded: []string{"6.6.6.6, 1.2.3.4"}, behindRouter: true, ip: "1.2.3.4"},
+		{remoteAddr: "10.0.0.1:5000", forwarded: []string{"6.6.6.6", "1.2.3.4"}, behindRouter: true, ip: "1.2.3.4"},
+		{remoteAddr: "10.0.0.1:5000", behindRouter: true, ip: "10.0.0.1"},
+	} {
+		req := &http.Request{RemoteAddr: test.remoteAddr, Header: http.Header{}}
+		for _, v := range test.forwarded {
+			req.Header.Add("X-Forwarded-For", v)
+		}
+		s := &Server{behindRouter: test.behindRouter}
+		if ip := s.remoteIP(req); ip != test.ip {
+			t.Fatalf("expected IP %q for %s forwarded for %v (behind router: %t), got %q", test.ip, test.remoteAddr, test.forwarded, test.behindRouter, ip)
+		}
+	}
+}
+
+// TestAuditLog tests that changes to repos and manual deploys are recorded
+// in the audit log, which cannot be changed
+func TestAuditLog(t *testing.T) {
+	db, err := setupTestDB("flynn_webhook_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	srv := NewServer(db, newFakeAppClient("foo", "foo-production"), nil)
+	if err := srv.setUserPassword("admin", "password", true); err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewServer(srv)
+	defer s.Close()
+
+	req, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("admin", "password")
+	admin := req.Header.Get("Authorization")
+
+	start := time.Now().Add(-time.Minute)
+	var repo Repo
+	if _, err := sendAuthJSON("POST", s.URL+"/repos", admin, `{"name":"lmars/foo","apps":["foo"]}`, &repo); err != nil {
+		t.Fatal(err)
+	}
+	repoURL := fmt.Sprintf("%s/repos/%d", s.URL, repo.ID)
+	var deploys []*Deploy
+	for _, r := range []struct {
+		method string
+		url    string
+		body   string
+		out    interface{}
+	}{
+		{"PATCH", repoURL, `{"apps":["foo","foo-production"]}`, nil},
+		{"POST", repoURL + "/deploys", `{"commit":"a1b2c3","apps":["foo-production"],"clone_url":"https://github.com/lmars/foo.git"}`, &deploys},
+		{"DELETE", repoURL, "", nil},
+	} {
+		res, err := sendAuthJSON(r.method, r.url, admin, r.body, r.out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode >= 300 {
+			t.Fatalf("unexpected response to %s %s: %s", r.method, r.url, res.Status)
+		}
+	}
+
+	for _, test := range []struct {
+		query   url.Values
+		actions string
+	}{
+		{query: nil, actions: "[repo.delete deploy.trigger repo.update repo.create]"},
+		{query: url.Values{"app": {"foo-production"}}, actions: "[repo.delete deploy.trigger repo.update]"},
+		{query: url.Values{"action": {"deploy.trigger"}}, actions: "[deploy.trigger]"},
+		{query: url.Values{"actor": {"admin"}, "since": {start.Format(time.RFC3339)}}, actions: "[repo.delete deploy.trigger repo.update repo.create]"},
+		{query: url.Values{"actor": {"someone"}}, actions: "[]"},
+		{query: url.Values{"until": {start.Format(time.RFC3339)}}, actions: "[]"},
+	} {
+		var events []*AuditEvent
+		res, err := sendAuthJSON("GET", s.URL+"/audit.json?"+test.query.Encode(), admin, "", &events)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("expected ok response, got %s", res.Status)
+		}
+		actions := make([]string, len(events))
+		for i, e := range events {
+			actions[i] = e.Action
+			if e.Actor != "admin" || e.IP != "127.0.0.1" || e.UserID == nil {
+				t.Fatalf("unexpected audit event: %+v", e)
+			}
+		}
+		if fmt.Sprint(actions) != test.actions {
+			t.Fatalf("expected %s for %v, got %v", test.actions, test.query, actions)
+		}
+	}
+
+	// the update records the repo as it was before being changed
+	var updates []*AuditEvent
+	if _, err := sendAuthJSON("GET", s.URL+"/audit.json?action=repo.update", admin, "", &updates); err != nil {
+		t.Fatal(err)
+	}
+	if len(updates) != 1 {
+		t.Fatalf("expected 1 repo.update event, got %d", len(updates))
+	}
+	details, _ := updates[0].Details.(map[string]interface{})
+	before, _ := details["before"].(map[string]interface{})
+	after, _ := details["after"].(map[string]interface{})
+	if fmt.Sprint(before["apps"], before["app_ids"]) != "[foo] [foo-id]" {
+		t.Fatalf("unexpected repo before the update: %v", before)
+	}
+	if fmt.Sprint(after["apps"], after["app_ids"]) != "[foo foo-production] [foo-id foo-production-id]" {
+		t.Fatalf("unexpected repo after the update: %v", after)
+	}
+
+	if err := db.Exec("UPDATE audit_events SET actor = 'someone'"); err == nil {
+		t.Fatal("expected audit events to be append-only")
+	}
+	if err := db.Exec("DELETE FROM audit_events"); err == nil {
+		t.Fatal("expected audit events to be append-only")
+	}
+
+	// changes which cannot be audited are not made
+	if err := db.Exec("ALTER TABLE audit_events RENAME TO audit_events_unavailable"); err != nil {
+		t.Fatal(err)
+	}
+	res, err := sendAuthJSON("POST", s.URL+"/repos", admin, `{"name":"lmars/bar","apps":["foo"]}`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("expected 500 response when the audit event cannot be recorded, got %s", res.Status)
+	}
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM repos WHERE name = 'lmars/bar'").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Fatalf("expected the unaudited repo not to be added, got %d", count)
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/flynn/flynn/pkg/postgres"
+	"github.com/jackc/pgx"
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// sessionTTL is how long a login session lasts.
+const sessionTTL = 7 * 24 * time.Hour
+
+// sessionCookie is the name of the cookie holding the session token.
+const sessionCookie = "session"
+
+// loginCSRFCookie is the name of the cookie holding the token which the CSRF
+// token of the login form is derived from, since there is no session to
+// derive it from until the user has logged in.
+const loginCSRFCookie = "login_csrf"
+
+// dummyHash is compared with the password when logging in as an unknown
+// user so that the response time does not reveal which users exist.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+// User is a user who can log in to the UI and use the JSON API. Admin users
+// can access all apps and manage other users, whereas other users can only
+// access the apps they have been granted a role for.
+type User struct {
+	ID        int32      `json:"id"`
+	Username  string     `json:"username"`
+	Password  string     `json:"password,omitempty"`
+	Admin     bool       `json:"admin"`
+	CreatedAt *time.Time `json:"created_at"`
+}
+
+const userColumns = "users.id, users.username, users.admin, users.created_at"
+
+func scanUser(s postgres.Scanner) (*User, error) {
+	u := &User{}
+	return u, s.Scan(&u.ID, &u.Username, &u.Admin, &u.CreatedAt)
+}
+
+// isPublic returns whether the request can be made without logging in,
+// which is the case for webhooks (authenticated by their signature), the
+// login page and static assets.
+func isPublic(req *http.Request) bool {
+	switch {
+	case isWebhook(req):
+		return true
+	case req.URL.Path == "/login":
+		return true
+	case strings.HasPrefix(req.URL.Path, "/assets/"):
+		return true
+	}
+	return false
+}
+
+// isWebhook returns whether the request is a webhook.
+func isWebhook(req *http.Request) bool {
+	return req.Method == "POST" && req.URL.Path == "/"
+}
+
+// authenticate returns the caller authenticated by either an API token,
+// HTTP basic auth or the session cookie, or nil if the request is not
+// authenticated.
+func (s *Server) authenticate(req *http.Request) (*Caller, error) {
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return s.authenticateToken(strings.TrimPrefix(auth, "Bearer "))
+	}
+	if username, password, ok := req.BasicAuth(); ok {
+		user, err := s.checkPassword(username, password)
+		if user == nil || err != nil {
+			return nil, err
+		}
+		return s.userCaller(user)
+	}
+	cookie, err := req.Cookie(sessionCookie)
+	if err != nil {
+		return nil, nil
+	}
+	user, err := scanUser(s.db.QueryRow(
+		"SELECT "+userColumns+" FROM sessions JOIN users ON users.id = sessions.user_id WHERE sessions.id = $1 AND sessions.expires_at > now()",
+		hashToken(cookie.Value),
+	))
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	caller, err := s.userCaller(user)
+	if err != nil {
+		return nil, err
+	}
+	caller.sessionToken = cookie.Value
+	return caller, nil
+}
+
+// checkPassword returns the user if the password is correct, or nil if the
+// user does not exist or the password is wrong.
+func (s *Server) checkPassword(username, password string) (*User, error) {
+	user := &User{}
+	var hash []byte
+	err := s.db.QueryRow("SELECT "+userColumns+", users.password_hash FROM users WHERE username = $1", username).Scan(&user.ID, &user.Username, &user.Admin, &user.CreatedAt, &hash)
+	if err == pgx.ErrNoRows {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return nil, nil
+	}
+	return user, nil
+}
+
+// requireAuth serves the request if it is public or authenticated,
+// otherwise redirecting the UI to the login page and responding to other
+// requests with 401 Unauthorized.
+//
+// Requests which change state are rejected if they come from another
+// origin, or are authenticated by a login session without its CSRF token.
+func (s *Server) requireAuth(w http.ResponseWriter, req *http.Request) {
+	if !isWebhook(req) && !s.checkOrigin(w, req) {
+		return
+	}
+	if s.authDisabled || isPublic(req) {
+		s.router.ServeHTTP(w, req)
+		return
+	}
+	caller, err := s.authenticate(req)
+	if err != nil {
+		log.Println("error authenticating request:", err)
+		http.Error(w, "error authenticating request", 500)
+		return
+	}
+	if caller == nil {
+		if req.Method == "GET" && req.URL.Path == "/" {
+			http.Redirect(w, req, "/login", 302)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="flynn-webhook-deploy"`)
+		http.Error(w, "authentication required", 401)
+		return
+	}
+	if caller.sessionToken != "" && !isSafeMethod(req.Method) && !validCSRFToken(req, caller.sessionToken) {
+		http.Error(w, "invalid CSRF token", 403)
+		return
+	}
+	s.router.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), callerContextKey{}, caller)))
+}
+
+// loginPage renders the login form, including a CSRF token derived from a
+// token in the login_csrf cookie so that other sites cannot log the user in
+// to an account of their choosing.
+func (s *Server) loginPage(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	tmpl, err := template.ParseFiles("assets/login.html")
+	if err != nil {
+		log.Println("error parsing login template:", err)
+		http.Error(w, "error rendering login page", 500)
+		return
+	}
+	// reuse an existing token so that the form can be open in several
+	// tabs
+	var token string
+	if cookie, err := req.Cookie(loginCSRFCookie); err == nil && cookie.Value != "" {
+		token = cookie.Value
+	} else {
+		token, err = randomToken()
+		if err != nil {
+			log.Println("error generating login CSRF token:", err)
+			http.Error(w, "error rendering login page", 500)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     loginCSRFCookie,
+			Value:    token,
+			Path:     "/login",
+			HttpOnly: true,
+			Secure:   isHTTPS(req),
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	data := struct{ CSRFToken string }{csrfToken(token)}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := tmpl.Execute(w, data); err != nil {
+		log.Println("error rendering login template:", err)
+	}
+}
+
+// login checks the username and password submitted from the login page,
+// starting a session and redirecting to the UI if they are correct.
+func (s *Server) login(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	if cookie, err := req.Cookie(loginCSRFCookie); err != nil || !validCSRFToken(req, cookie.Value) {
+		http.Error(w, "invalid CSRF token", 403)
+		return
+	}
+	user, err := s.checkPassword(req.FormValue("username"), req.FormValue("password"))
+	if err != nil {
+		log.Println("error checking password:", err)
+		http.Error(w, "error logging in", 500)
+		return
+	}
+	if user == nil {
+		log.Printf("failed login for user %q\n", req.FormValue("username"))
+		http.Redirect(w, req, "/login?failed=true", 302)
+		return
+	}
+	token, err := randomToken()
+	if err != nil {
+		log.Println("error generating session token:", err)
+		http.Error(w, "error logging in", 500)
+		return
+	}
+	if err := s.db.Exec("DELETE FROM sessions WHERE expires_at < now()"); err != nil {
+		log.Println("error deleting expired sessions:", err)
+	}
+	if err := s.db.Exec(
+		"INSERT INTO sessions (id, user_id, expires_at) VALUES ($1, $2, now() + $3 * interval '1 second')",
+		hashToken(token), user.ID, sessionTTL.Seconds(),
+	); err != nil {
+		log.Println("error creating session:", err)
+		http.Error(w, "error logging in", 500)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  time.Now().Add(sessionTTL),
+		HttpOnly: true,
+		Secure:   isHTTPS(req),
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, req, "/", 302)
+}
+
+// logout ends the current session.
+func (s *Server) logout(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	if cookie, err := req.Cookie(sessionCookie); err == nil {
+		if err := s.db.Exec("DELETE FROM sessions WHERE id = $1", hashToken(cookie.Value)); err != nil {
+			log.Println("error deleting session:", err)
+			http.Error(w, "error logging out", 500)
+			return
+		}
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   isHTTPS(req),
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, req, "/login", 302)
+}
+
+// setUserPassword creates the user with the given password, or sets the
+// password and whether they are an admin if the user already exists.
+func (s *Server) setUserPassword(username, password string, admin bool) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	return s.db.Exec(
+		"INSERT INTO users (username, password_hash, admin) VALUES ($1, $2, $3) ON CONFLICT (username) DO UPDATE SET password_hash = $2, admin = $3",
+		username, hash, admin,
+	)
+}
+
+// randomToken returns a random hex encoded 32 byte token.
+func randomToken() (string, error) {
+	data := make([]byte, 32)
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(data), nil
+}
+
+// hashToken returns the hash of a token, which is stored in the db rather
+// than the token itself.
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// isHTTPS returns whether the request was made over HTTPS, either directly
+// or via the Flynn router.
+func isHTTPS(req *http.Request) bool {
+	return req.TLS != nil || req.Header.Get("X-Forwarded-Proto") == "https"
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// TestAuth tests that everything other than webhooks requires either a
+// login session or HTTP basic auth
+func TestAuth(t *testing.T) {
+	db, err := setupTestDB("flynn_webhook_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	secretToken := []byte("secret")
+	srv := NewServer(db, newFakeAppClient("foo"), secretToken)
+	if err := srv.setUserPassword("admin", "password", true); err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewServer(srv)
+	defer s.Close()
+
+	// do not follow redirects so they can be checked
+	noRedirect := func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	client := &http.Client{CheckRedirect: noRedirect}
+
+	get := func(path string, setup func(*http.Request)) *http.Response {
+		req, err := http.NewRequest("GET", s.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if setup != nil {
+			setup(req)
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	for _, test := range []struct {
+		path   string
+		auth   func(*http.Request)
+		status int
+	}{
+		{path: "/", status: http.StatusFound},
+		{path: "/repos.json", status: http.StatusUnauthorized},
+		{path: "/apps.json", status: http.StatusUnauthorized},
+		{path: "/repos.json", auth: func(req *http.Request) { req.SetBasicAuth("admin", "wrong") }, status: http.StatusUnauthorized},
+		{path: "/repos.json", auth: func(req *http.Request) { req.SetBasicAuth("nobody", "password") }, status: http.StatusUnauthorized},
+		{path: "/repos.json", auth: func(req *http.Request) { req.SetBasicAuth("admin", "password") }, status: http.StatusOK},
+		{path: "/repos.json", auth: func(req *http.Request) { req.AddCookie(&http.Cookie{Name: sessionCookie, Value: "invalid"}) }, status: http.StatusUnauthorized},
+		{path: "/login", status: http.StatusOK},
+	} {
+		if res := get(test.path, test.auth); res.StatusCode != test.status {
+			t.Fatalf("expected %d response for %s, got %s", test.status, test.path, res.Status)
+		}
+	}
+
+	// webhooks are only authenticated by their signature
+	event := Event{Repository: Repository{FullName: "lmars/foo"}}
+	res, err := sendWebhook(s.URL, "ping", event, secretToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected ok webhook response, got %s", res.Status)
+	}
+
+	// log in with a session
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Jar = jar
+
+	// logging in requires the CSRF token from the login page
+	res, err = client.PostForm(s.URL+"/login", url.Values{"username": {"admin"}, "password": {"password"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 response logging in without a CSRF token, got %s", res.Status)
+	}
+	res, err = client.Get(s.URL + "/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	match := regexp.MustCompile(`name="csrf_token" value="([0-9a-f]+)"`).FindSubmatch(page)
+	if match == nil {
+		t.Fatalf("expected a CSRF token in the login page, got %s", page)
+	}
+	loginToken := string(match[1])
+
+	res, err = client.PostForm(s.URL+"/login", url.Values{"username": {"admin"}, "password": {"wrong"}, csrfField: {loginToken}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if loc := res.Header.Get("Location"); loc != "/login?failed=true" {
+		t.Fatalf("expected failed login to redirect to the login page, got %q", loc)
+	}
+	res, err = client.PostForm(s.URL+"/login", url.Values{"username": {"admin"}, "password": {"password"}, csrfField: {loginToken}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if loc := res.Header.Get("Location"); loc != "/" {
+		t.Fatalf("expected login to redirect to the UI, got %q", loc)
+	}
+	if cookie := res.Header.Get("Set-Cookie"); !strings.Contains(cookie, "SameSite=Lax") {
+		t.Fatalf("expected a SameSite session cookie, got %q", cookie)
+	}
+	if res := get("/repos.json", nil); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected ok response with a session, got %s", res.Status)
+	}
+
+	// requests using the session must include its CSRF token
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookies := jar.Cookies(u)
+	if len(cookies) != 1 || cookies[0].Name != sessionCookie {
+		t.Fatalf("expected a session cookie, got %v", cookies)
+	}
+	res, err = client.PostForm(s.URL+"/logout", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 response without a CSRF token, got %s", res.Status)
+	}
+
+	// log out
+	res, err = client.PostForm(s.URL+"/logout", url.Values{csrfField: {csrfToken(cookies[0].Value)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res := get("/repos.json", nil); res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 response after logging out, got %s", res.Status)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// checkBitbucketSignature checks the HMAC-SHA256 X-Hub-Signature header
+// sent by both Bitbucket Cloud and Bitbucket Server.
+func checkBitbucketSignature(h http.Header, body []byte, secrets [][]byte) error {
+	sig := h.Get("X-Hub-Signature")
+	if sig == "" {
+		return errors.New("missing X-Hub-Signature header")
+	}
+	if !validHMAC(sig, "sha256=", sha256.New, body, secrets) {
+		return errors.New("invalid X-Hub-Signature header")
+	}
+	return nil
+}
+
+// bitbucketCloudProvider handles webhooks sent by Bitbucket Cloud
+// (bitbucket.org), which are distinguished from Bitbucket Server webhooks
+// by the X-Hook-UUID header.
+type bitbucketCloudProvider struct{}
+
+// bitbucketCloudPushEvent is the payload of a Bitbucket Cloud "repo:push"
+// event.
+type bitbucketCloudPushEvent struct {
+	Push struct {
+		Changes []struct {
+			New *bitbucketCloudRef `json:"new"`
+			Old *bitbucketCloudRef `json:"old"`
+		} `json:"changes"`
+	} `json:"push"`
+	Repository struct {
+		FullName string `json:"full_name"`
+		Links    struct {
+			HTML struct {
+				Href string `json:"href"`
+			} `json:"html"`
+		} `json:"links"`
+	} `json:"repository"`
+}
+
+type bitbucketCloudRef struct {
+	Type   string `json:"type"`
+	Name   string `json:"name"`
+	Target struct {
+		Hash    string `json:"hash"`
+		Message string `json:"message"`
+	} `json:"target"`
+}
+
+// ref returns the full git ref of a Bitbucket Cloud branch or tag.
+func (r *bitbucketCloudRef) ref() string {
+	if r.Type == "tag" {
+		return "refs/tags/" + r.Name
+	}
+	return "refs/heads/" + r.Name
+}
+
+func (bitbucketCloudProvider) Name() string {
+	return "bitbucket"
+}
+
+func (bitbucketCloudProvider) EventType(h http.Header) string {
+	if h.Get("X-Hook-UUID") == "" {
+		return ""
+	}
+	return h.Get("X-Event-Key")
+}
+
+func (bitbucketCloudProvider) DeliveryID(h http.Header) string {
+	return h.Get("X-Request-UUID")
+}
+
+func (bitbucketCloudProvider) RepoName(body []byte) string {
+	var event bitbucketCloudPushEvent
+	json.Unmarshal(body, &event)
+	return event.Repository.FullName
+}
+
+func (bitbucketCloudProvider) Authenticate(h http.Header, body []byte, secrets [][]byte) error {
+	return checkBitbucketSignature(h, body, secrets)
+}
+
+// Events returns an event for each branch or tag changed by the push.
+func (bitbucketCloudProvider) Events(eventType string, body []byte) ([]*Event, error) {
+	if eventType != "repo:push" {
+		return nil, errors.New("unknown X-Event-Key: " + eventType)
+	}
+	var payload bitbucketCloudPushEvent
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, errInvalidJSON
+	}
+	repo := Repository{
+		FullName: payload.Repository.FullName,
+		CloneURL: payload.Repository.Links.HTML.Href + ".git",
+		URL:      payload.Repository.Links.HTML.Href,
+	}
+	events := make([]*Event, 0, len(payload.Push.Changes))
+	for _, change := range payload.Push.Changes {
+		event := &Event{Repository: repo}
+		if change.New != nil {
+			event.Ref = change.New.ref()
+			event.HeadCommit = Commit{ID: change.New.Target.Hash, Message: change.New.Target.Message}
+		} else if change.Old != nil {
+			// the branch or tag was deleted
+			event.Ref = change.Old.ref()
+			event.Deleted = true
+		} else {
+			continue
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// bitbucketServerProvider handles webhooks sent by self-hosted Bitbucket
+// Server (and Data Center), which identifies repos by project key and slug.
+type bitbucketServerProvider struct{}
+
+// bitbucketServerEvent is the payload of a Bitbucket Server
+// "repo:refs_changed" event.
+type bitbucketServerEvent struct {
+	Repository struct {
+		Slug    string `json:"slug"`
+		Project struct {
+			Key string `json:"key"`
+		} `json:"project"`
+		Links struct {
+			Clone []struct {
+				Href string `json:"href"`
+				Name string `json:"name"`
+			} `json:"clone"`
+			Self []struct {
+				Href string `json:"href"`
+			} `json:"self"`
+		} `json:"links"`
+	} `json:"repository"`
+	Changes []struct {
+		RefID  string `json:"refId"`
+		ToHash string `json:"toHash"`
+		Type   string `json:"type"`
+	} `json:"changes"`
+}
+
+// fullName returns the name of the repo in the form "PROJECT/slug".
+func (e *bitbucketServerEvent) fullName() string {
+	if e.Repository.Slug == "" {
+		return ""
+	}
+	return e.Repository.Project.Key + "/" + e.Repository.Slug
+}
+
+func (bitbucketServerProvider) Name() string {
+	return "bitbucket-server"
+}
+
+func (bitbucketServerProvider) EventType(h http.Header) string {
+	if h.Get("X-Hook-UUID") != "" {
+		return ""
+	}
+	return h.Get("X-Event-Key")
+}
+
+func (bitbucketServerProvider) DeliveryID(h http.Header) string {
+	return h.Get("X-Request-Id")
+}
+
+func (bitbucketServerProvider) RepoName(body []byte) string {
+	var event bitbucketServerEvent
+	json.Unmarshal(body, &event)
+	return event.fullName()
+}
+
+func (bitbucketServerProvider) Authenticate(h http.Header, body []byte, secrets [][]byte) error {
+	return checkBitbucketSignature(h, body, secrets)
+}
+
+// Events returns an event for each ref changed by the push.
+func (bitbucketServerProvider) Events(eventType string, body []byte) ([]*Event, error) {
+	switch eventType {
+	case "diagnostics:ping":
+		return nil, errPing
+	case "repo:refs_changed":
+	default:
+		return nil, errors.New("unknown X-Event-Key: " + eventType)
+	}
+	var payload bitbucketServerEvent
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, errInvalidJSON
+	}
+	repo := Repository{FullName: payload.fullName()}
+	for _, link := range payload.Repository.Links.Clone {
+		if link.Name == "http" || link.Name == "https" {
+			repo.CloneURL = link.Href
+		}
+	}
+	if len(payload.Repository.Links.Self) > 0 {
+		repo.URL = payload.Repository.Links.Self[0].Href
+	}
+	events := make([]*Event, 0, len(payload.Changes))
+	for _, change := range payload.Changes {
+		events = append(events, &Event{
+			Ref:        change.RefID,
+			Deleted:    strings.ToUpper(change.Type) == "DELETE",
+			HeadCommit: Commit{ID: change.ToHash},
+			Repository: repo,
+		})
+	}
+	return events, nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const bitbucketCloudPushPayload = `{
+  "push": {
+    "changes": [
+      {"new": {"type": "branch", "name": "master", "target": {"hash": "a1"}}, "old": {"type": "branch", "name": "master", "target": {"hash": "a0"}}},
+      {"new": {"type": "branch", "name": "develop", "target": {"hash": "b1"}}, "old": null},
+      {"new": null, "old": {"type": "branch", "name": "feature", "target": {"hash": "c0"}}}
+    ]
+  },
+  "repository": {
+    "full_name": "lmars/foo",
+    "links": {"html": {"href": "https://bitbucket.org/lmars/foo"}}
+  }
+}`
+
+const bitbucketServerPushPayload = `{
+  "eventKey": "repo:refs_changed",
+  "repository": {
+    "slug": "foo",
+    "project": {"key": "LMARS"},
+    "links": {
+      "clone": [
+        {"href": "ssh://git@bitbucket.example.com:7999/lmars/foo.git", "name": "ssh"},
+        {"href": "https://bitbucket.example.com/scm/lmars/foo.git", "name": "http"}
+      ],
+      "self": [{"href": "https://bitbucket.example.com/projects/LMARS/repos/foo/browse"}]
+    }
+  },
+  "changes": [
+    {"refId": "refs/heads/master", "fromHash": "a0", "toHash": "a1", "type": "UPDATE"},
+    {"refId": "refs/heads/feature", "fromHash": "c0", "toHash": "0000000000000000000000000000000000000000", "type": "DELETE"}
+  ]
+}`
+
+// TestBitbucketCloudEvents tests that Bitbucket Cloud pushes are converted
+// to an event per changed branch
+func TestBitbucketCloudEvents(t *testing.T) {
+	events, err := bitbucketCloudProvider{}.Events("repo:push", []byte(bitbucketCloudPushPayload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Event{
+		{Ref: "refs/heads/master", HeadCommit: Commit{ID: "a1"}},
+		{Ref: "refs/heads/develop", HeadCommit: Commit{ID: "b1"}},
+		{Ref: "refs/heads/feature", Deleted: true},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("expected %d events, got %d", len(expected), len(events))
+	}
+	for i, event := range events {
+		if event.Ref != expected[i].Ref || event.Deleted != expected[i].Deleted || event.HeadCommit.ID != expected[i].HeadCommit.ID {
+			t.Fatalf("expected event %d to be %+v, got %+v", i, expected[i], event)
+		}
+		if event.Repository.FullName != "lmars/foo" || event.Repository.CloneURL != "https://bitbucket.org/lmars/foo.git" {
+			t.Fatalf("unexpected repository: %+v", event.Repository)
+		}
+	}
+}
+
+// TestBitbucketServerEvents tests that Bitbucket Server ref changes are
+// converted to an event per changed ref
+func TestBitbucketServerEvents(t *testing.T) {
+	p := bitbucketServerProvider{}
+	if name := p.RepoName([]byte(bitbucketServerPushPayload)); name != "LMARS/foo" {
+		t.Fatalf(`expected repo name "LMARS/foo", got %q`, name)
+	}
+	events, err := p.Events("repo:refs_changed", []byte(bitbucketServerPushPayload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(events))
+	}
+	if events[0].Ref != "refs/heads/master" || events[0].HeadCommit.ID != "a1" || events[0].Deleted {
+		t.Fatalf("unexpected event: %+v", events[0])
+	}
+	if events[0].Repository.CloneURL != "https://bitbucket.example.com/scm/lmars/foo.git" {
+		t.Fatalf("unexpected clone URL: %q", events[0].Repository.CloneURL)
+	}
+	if !events[1].Deleted {
+		t.Fatalf("expected deleted event, got %+v", events[1])
+	}
+	if _, err := p.Events("diagnostics:ping", nil); err != errPing {
+		t.Fatalf("expected ping, got %v", err)
+	}
+}
+
+// TestBitbucketProviderDispatch tests that Bitbucket Cloud and Server
+// webhooks are dispatched to the correct provider
+func TestBitbucketProviderDispatch(t *testing.T) {
+	s := newTestServer(nil, nil, nil)
+	for _, test := range []struct {
+		header   http.Header
+		provider string
+	}{
+		{http.Header{"X-Event-Key": {"repo:push"}, "X-Hook-Uuid": {"1234"}}, "bitbucket"},
+		{http.Header{"X-Event-Key": {"repo:refs_changed"}, "X-Request-Id": {"1234"}}, "bitbucket-server"},
+		{http.Header{"X-Github-Event": {"push"}}, "github"},
+	} {
+		p, _ := s.findProvider(test.header)
+		if p == nil || p.Name() != test.provider {
+			t.Fatalf("expected provider %q, got %v", test.provider, p)
+		}
+	}
+}
+
+// TestBitbucketWebhook tests that a Bitbucket push which changes multiple
+// branches queues a deploy for each branch with a matching repo
+func TestBitbucketWebhook(t *testing.T) {
+	db, err := setupTestDB("flynn_webhook_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	secretToken := []byte("secret")
+	s := httptest.NewServer(newTestServer(db, nil, secretToken))
+	defer s.Close()
+
+	if err := db.Exec("INSERT INTO repos (provider, name, branch, apps) VALUES ('bitbucket', 'lmars/foo', 'master', '{foo}'), ('bitbucket', 'lmars/foo', 'develop', '{foo-dev}')"); err != nil {
+		t.Fatal(err)
+	}
+
+	body := []byte(bitbucketCloudPushPayload)
+	req, err := http.NewRequest("POST", s.URL, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Event-Key", "repo:push")
+	req.Header.Set("X-Hook-UUID", "1234")
+	req.Header.Set("X-Hub-Signature", signBody(body, "sha256=", sha256.New, secretToken))
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected ok response, got %s", res.Status)
+	}
+
+	var apps []string
+	if err := db.QueryRow("SELECT array_agg(app ORDER BY app) FROM deploys").Scan(&apps); err != nil {
+		t.Fatal(err)
+	}
+	if len(apps) != 2 || apps[0] != "foo" || apps[1] != "foo-dev" {
+		t.Fatalf(`expected deploys of "foo" and "foo-dev", got %v`, apps)
+	}
+}
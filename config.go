@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path/filepath"
+
+	"github.com/julienschmidt/httprouter"
+	"gopkg.in/yaml.v2"
+)
+
+// Config is a declarative list of repos, loaded from the file in REPO_CONFIG
+// at startup and returned by GET /config/export.
+type Config struct {
+	Repos []RepoConfig `json:"repos" yaml:"repos"`
+}
+
+// RepoConfig is the configuration of a repo in a Config, which has the same
+// fields as a Repo other than those managed by the server.
+type RepoConfig struct {
+	Provider        string   `json:"provider,omitempty" yaml:"provider,omitempty"`
+	Name            string   `json:"name" yaml:"name"`
+	Branch          string   `json:"branch,omitempty" yaml:"branch,omitempty"`
+	TagPattern      string   `json:"tag_pattern,omitempty" yaml:"tag_pattern,omitempty"`
+	Apps            []string `json:"apps" yaml:"apps"`
+	IncludePaths    []string `json:"include_paths,omitempty" yaml:"include_paths,omitempty"`
+	ExcludePaths    []string `json:"exclude_paths,omitempty" yaml:"exclude_paths,omitempty"`
+	BuildContext    string   `json:"build_context,omitempty" yaml:"build_context,omitempty"`
+	PreviewTemplate string   `json:"preview_template,omitempty" yaml:"preview_template,omitempty"`
+}
+
+// Repo returns a Repo with the settings in the config.
+func (c RepoConfig) Repo() Repo {
+	return Repo{
+		Provider:        c.Provider,
+		Name:            c.Name,
+		Branch:          c.Branch,
+		TagPattern:      c.TagPattern,
+		Apps:            c.Apps,
+		IncludePaths:    c.IncludePaths,
+		ExcludePaths:    c.ExcludePaths,
+		BuildContext:    c.BuildContext,
+		PreviewTemplate: c.PreviewTemplate,
+	}
+}
+
+// newRepoConfig returns the config of an existing repo.
+func newRepoConfig(r Repo) RepoConfig {
+	return RepoConfig{
+		Provider:        r.Provider,
+		Name:            r.Name,
+		Branch:          r.Branch,
+		TagPattern:      r.TagPattern,
+		Apps:            r.Apps,
+		IncludePaths:    r.IncludePaths,
+		ExcludePaths:    r.ExcludePaths,
+		BuildContext:    r.BuildContext,
+		PreviewTemplate: r.PreviewTemplate,
+	}
+}
+
+// parseConfig parses a config file, which is JSON if the file has a .json
+// extension and YAML otherwise.
+func parseConfig(filename string, data []byte) (*Config, error) {
+	config := &Config{}
+	var err error
+	if filepath.Ext(filename) == ".json" {
+		// reject unknown keys like yaml.UnmarshalStrict so that a
+		// misspelled setting is not synced as if it were missing
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err = dec.Decode(config); err == nil && dec.More() {
+			err = errors.New("unexpected data after the config")
+		}
+	} else {
+		err = yaml.UnmarshalStrict(data, config)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// ruleKey returns a key which identifies a repo by the settings covered by
+// the repos_rule_key constraint, so that config repos can be matched with
+// repos in the db.
+func ruleKey(r Repo) string {
+	// copy the paths so that nil and empty lists have the same key
+	include := append([]string{}, r.IncludePaths...)
+	exclude := append([]string{}, r.ExcludePaths...)
+	key, _ := json.Marshal([]interface{}{r.Provider, r.Name, r.Branch, r.TagPattern, include, exclude, r.BuildContext, r.PreviewTemplate})
+	return string(key)
+}
+
+// syncConfigFile loads the config file and syncs it with the db.
+func (s *Server) syncConfigFile(filename string) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	config, err := parseConfig(filename, data)
+	if err != nil {
+		return fmt.Errorf("error parsing %s: %s", filename, err)
+	}
+	return s.syncConfig(config)
+}
+
+// syncConfig makes the repos in the db match the config, updating the apps
+// of repos which are in both, adding missing repos and deleting repos which
+// are not in the config.
+//
+// Repos which are kept keep their ID, webhook secret and deploy history.
+func (s *Server) syncConfig(config *Config) error {
+	repos := make([]Repo, len(config.Repos))
+	keys := make(map[string]int, len(config.Repos))
+	for i, c := range config.Repos {
+		repo := c.Repo()
+		if err := s.validateRepo(&repo); err != nil {
+			return fmt.Errorf("invalid repo %d (%s): %s", i, c.Name, err)
+		}
+		if err := s.lookupApps(&repo); err != nil {
+			return fmt.Errorf("invalid repo %d (%s): %s", i, c.Name, err)
+		}
+		key := ruleKey(repo)
+		if j, ok := keys[key]; ok {
+			return fmt.Errorf("repo %d (%s) has the same settings as repo %d", i, c.Name, j)
+		}
+		keys[key] = i
+		repos[i] = repo
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT " + repoColumns + " FROM repos")
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]Repo)
+	for rows.Next() {
+		repo, err := scanRepo(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		existing[ruleKey(repo)] = repo
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var events []*AuditEvent
+	for _, repo := range repos {
+		key := ruleKey(repo)
+		if current, ok := existing[key]; ok {
+			delete(existing, key)
+			if fmt.Sprint(current.AppIDs) == fmt.Sprint(repo.AppIDs) && fmt.Sprint(current.Apps) == fmt.Sprint(repo.Apps) {
+				continue
+			}
+			if err := tx.Exec("UPDATE repos SET apps = $1, app_ids = $2 WHERE id = $3", repo.Apps, repo.AppIDs, current.ID); err != nil {
+				return err
+			}
+			repo.ID = current.ID
+			repo.HasSecret = current.HasSecret
+			repo.CreatedAt = current.CreatedAt
+			events = append(events, &AuditEvent{
+				Action:  AuditRepoUpdate,
+				Apps:    appendMissing(current.Apps, repo.Apps...),
+				RepoID:  &current.ID,
+				Details: map[string]interface{}{"before": current, "after": repo},
+			})
+			continue
+		}
+		if err := tx.QueryRow("INSERT INTO repos (provider, name, branch, tag_pattern, apps, app_ids, include_paths, exclude_paths, build_context, preview_template) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id, created_at",
+			repo.Provider, repo.Name, repo.Branch, repo.TagPattern, repo.Apps, repo.AppIDs, repo.IncludePaths, repo.ExcludePaths, repo.BuildContext, repo.PreviewTemplate,
+		).Scan(&repo.ID, &repo.CreatedAt); err != nil {
+			return err
+		}
+		events = append(events, newConfigRepoEvent(AuditRepoCreate, repo))
+	}
+	for _, repo := range existing {
+		if err := tx.Exec("DELETE FROM repos WHERE id = $1", repo.ID); err != nil {
+			return err
+		}
+		events = append(events, newConfigRepoEvent(AuditRepoDelete, repo))
+	}
+	counts := make(map[string]int)
+	for _, e := range events {
+		e.Actor = configActor
+		if err := tx.Exec(insertAuditEvent, e.insertArgs()...); err != nil {
+			return err
+		}
+		counts[e.Action]++
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log.Printf("synced repo config: %d added, %d updated, %d deleted\n", counts[AuditRepoCreate], counts[AuditRepoUpdate], counts[AuditRepoDelete])
+	return nil
+}
+
+// newConfigRepoEvent returns an audit event for a repo which was added or
+// deleted by syncing the config.
+func newConfigRepoEvent(action string, repo Repo) *AuditEvent {
+	return &AuditEvent{
+		Action:  action,
+		Apps:    repo.Apps,
+		RepoID:  &repo.ID,
+		Details: map[string]interface{}{"repo": repo},
+	}
+}
+
+// exportConfig returns the repos in the db as a config, as YAML unless the
+// format=json query parameter is set, using the current names of renamed
+// apps.
+func (s *Server) exportConfig(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	if !checkUnrestricted(w, req) {
+		return
+	}
+	rows, err := s.db.Query("SELECT " + repoColumns + " FROM repos ORDER BY id")
+	if err != nil {
+		log.Println("error getting repos from db:", err)
+		http.Error(w, "error getting repos", 500)
+		return
+	}
+	var repos []Repo
+	for rows.Next() {
+		repo, err := scanRepo(rows)
+		if err != nil {
+			rows.Close()
+			log.Println("error scanning db row:", err)
+			http.Error(w, "error getting repos", 500)
+			return
+		}
+		repos = append(repos, repo)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("error scanning db rows:", err)
+		http.Error(w, "error getting repos", 500)
+		return
+	}
+	names, err := s.appNames()
+	if err != nil {
+		log.Println("error getting apps:", err)
+		http.Error(w, "error getting apps", 500)
+		return
+	}
+	config := &Config{Repos: make([]RepoConfig, len(repos))}
+	for i, repo := range repos {
+		repo.refreshApps(names)
+		config.Repos[i] = newRepoConfig(repo)
+	}
+	if req.FormValue("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(config)
+		return
+	}
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		log.Println("error encoding config:", err)
+		http.Error(w, "error exporting config", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-yaml")
+	w.Write(data)
+}
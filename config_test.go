@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	expected := &Config{Repos: []RepoConfig{
+		{Name: "lmars/foo", Branch: "master", Apps: []string{"foo"}},
+		{Provider: "gitlab", Name: "lmars/bar", TagPattern: "v*", Apps: []string{"bar", "bar-worker"}, IncludePaths: []string{"services/bar"}, BuildContext: "services/bar"},
+	}}
+	for _, test := range []struct {
+		filename string
+		data     string
+		err      bool
+	}{
+		{
+			filename: "repos.yml",
+			data: `
+repos:
+- name: lmars/foo
+  branch: master
+  apps: [foo]
+- provider: gitlab
+  name: lmars/bar
+  tag_pattern: v*
+  apps:
+  - bar
+  - bar-worker
+  include_paths: [services/bar]
+  build_context: services/bar
+`,
+		},
+		{
+			filename: "repos.json",
+			data: `{"repos": [
+  {"name": "lmars/foo", "branch": "master", "apps": ["foo"]},
+  {"provider": "gitlab", "name": "lmars/bar", "tag_pattern": "v*", "apps": ["bar", "bar-worker"], "include_paths": ["services/bar"], "build_context": "services/bar"}
+]}`,
+		},
+		{
+			filename: "repos.yml",
+			data:     "repos:\n- name: lmars/foo\n  app: foo\n",
+			err:      true,
+		},
+		{
+			filename: "repos.json",
+			data:     "repos:\n- name: lmars/foo\n",
+			err:      true,
+		},
+		{
+			filename: "repos.json",
+			data:     `{"repos": [{"name": "lmars/foo", "app": "foo"}]}`,
+			err:      true,
+		},
+	} {
+		config, err := parseConfig(test.filename, []byte(test.data))
+		if test.err {
+			if err == nil {
+				t.Fatalf("expected error parsing %s: %s", test.filename, test.data)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("error parsing %s: %s", test.filename, err)
+		}
+		if !reflect.DeepEqual(config, expected) {
+			t.Fatalf("expected %s to parse as %+v, got %+v", test.filename, expected, config)
+		}
+	}
+}
+
+// TestSyncConfig tests that syncing a config adds, updates and deletes
+// repos, and that the config can be exported again
+func TestSyncConfig(t *testing.T) {
+	db, err := setupTestDB("flynn_webhook_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	srv := newTestServer(db, newFakeAppClient("foo", "foo-staging", "bar"), nil)
+	if err := db.Exec("INSERT INTO repos (name, branch, apps) VALUES ('lmars/foo', 'master', '{foo}'), ('lmars/foo', 'develop', '{foo-staging}'), ('lmars/old', 'master', '{old}')"); err != nil {
+		t.Fatal(err)
+	}
+	var masterID int32
+	if err := db.QueryRow("SELECT id FROM repos WHERE branch = 'master' AND name = 'lmars/foo'").Scan(&masterID); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &Config{Repos: []RepoConfig{
+		{Name: "lmars/foo", Apps: []string{"foo", "foo-staging"}},
+		{Name: "lmars/bar", TagPattern: "v*", Apps: []string{"bar"}},
+	}}
+	if err := srv.syncConfig(config); err != nil {
+		t.Fatal(err)
+	}
+
+	var repos []string
+	if err := db.QueryRow("SELECT array_agg(format('%s %s %s', name, branch || tag_pattern, apps) ORDER BY name) FROM repos").Scan(&repos); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(repos) != "[lmars/bar v* {bar} lmars/foo master {foo,foo-staging}]" {
+		t.Fatalf("unexpected repos after sync: %v", repos)
+	}
+	var count int
+	if err := db.QueryRow("SELECT count(*) FROM repos WHERE id = $1", masterID).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatal("expected the existing master repo to be updated rather than replaced")
+	}
+
+	// syncing again is a no-op
+	if err := srv.syncConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow("SELECT count(*) FROM repos").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Fatalf("expected 2 repos, got %d", count)
+	}
+
+	// invalid configs are not synced
+	for _, invalid := range []*Config{
+		{Repos: []RepoConfig{{Name: "lmars/foo", Apps: []string{"missing"}}}},
+		{Repos: []RepoConfig{{Name: "lmars/foo", Apps: []string{"foo"}}, {Name: "lmars/foo", Branch: "master", Apps: []string{"bar"}}}},
+		{Repos: []RepoConfig{{Name: "lmars/foo", Apps: []string{"foo"}, BuildContext: "services/foo"}}},
+	} {
+		if err := srv.syncConfig(invalid); err == nil {
+			t.Fatalf("expected error syncing %+v", invalid)
+		}
+	}
+
+	s := httptest.NewServer(srv)
+	defer s.Close()
+	res, err := http.Get(s.URL + "/config/export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected ok response, got %s", res.Status)
+	}
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exported, err := parseConfig("export.yml", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exported.Repos) != 2 {
+		t.Fatalf("expected 2 exported repos, got %+v", exported.Repos)
+	}
+	if err := srv.syncConfig(exported); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow("SELECT count(*) FROM repos").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Fatalf("expected 2 repos after syncing the export, got %d", count)
+	}
+}
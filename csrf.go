@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/flynn/flynn/pkg/cors"
+)
+
+// csrfHeader and csrfField are the request header and form field which
+// requests from the UI use to send the CSRF token.
+const (
+	csrfHeader = "X-CSRF-Token"
+	csrfField  = "csrf_token"
+)
+
+// csrfToken returns the CSRF token for a login session, which is derived
+// from the session token so that it is only valid for that session and
+// does not need to be stored.
+func csrfToken(sessionToken string) string {
+	mac := hmac.New(sha256.New, []byte(sessionToken))
+	mac.Write([]byte("csrf"))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// validCSRFToken returns whether the request has the CSRF token for the
+// session in either the header or the form.
+func validCSRFToken(req *http.Request, sessionToken string) bool {
+	token := req.Header.Get(csrfHeader)
+	if token == "" {
+		token = req.PostFormValue(csrfField)
+	}
+	return token != "" && hmac.Equal([]byte(token), []byte(csrfToken(sessionToken)))
+}
+
+// isSafeMethod returns whether requests with the method do not change any
+// state, so do not need protecting from cross-site request forgery.
+func isSafeMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS":
+		return true
+	}
+	return false
+}
+
+// newCORSOptions returns the options for cross-origin requests, which are
+// only allowed from the UI's own origin and the CORS_ALLOWED_ORIGINS, and
+// cannot include cookies so that other origins can only use API tokens.
+func (s *Server) newCORSOptions() *cors.Options {
+	return &cors.Options{
+		ShouldAllowOrigin: s.allowOrigin,
+		AllowMethods:      []string{"GET", "POST", "PUT", "PATCH", "DELETE", "HEAD"},
+		AllowHeaders:      []string{"Authorization", "Accept", "Content-Type"},
+		MaxAge:            time.Hour,
+	}
+}
+
+// allowOrigin returns whether requests from the origin are allowed.
+func (s *Server) allowOrigin(origin string, req *http.Request) bool {
+	if origin == requestOrigin(req) {
+		return true
+	}
+	for _, allowed := range s.allowedOrigins {
+		if origin == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// requestOrigin returns the origin which the request was made to.
+func requestOrigin(req *http.Request) string {
+	if isHTTPS(req) {
+		return "https://" + req.Host
+	}
+	return "http://" + req.Host
+}
+
+// checkOrigin writes a 403 Forbidden response and returns false if the
+// request would change state and was sent by a browser from an origin
+// which is not allowed.
+func (s *Server) checkOrigin(w http.ResponseWriter, req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if isSafeMethod(req.Method) || origin == "" || s.cors.IsOriginAllowed(origin, req) {
+		return true
+	}
+	http.Error(w, "cross-origin request not allowed", 403)
+	return false
+}
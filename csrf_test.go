@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestValidCSRFToken(t *testing.T) {
+	token := csrfToken("session")
+	if token == csrfToken("other-session") {
+		t.Fatal("expected CSRF tokens of different sessions to differ")
+	}
+	for _, test := range []struct {
+		header string
+		form   string
+		valid  bool
+	}{
+		{header: token, valid: true},
+		{form: token, valid: true},
+		{header: "invalid", form: token, valid: false},
+		{header: csrfToken("other-session"), valid: false},
+		{form: "", valid: false},
+	} {
+		req := httptest.NewRequest("POST", "/repos", strings.NewReader(url.Values{csrfField: {test.form}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if test.header != "" {
+			req.Header.Set(csrfHeader, test.header)
+		}
+		if valid := validCSRFToken(req, "session"); valid != test.valid {
+			t.Fatalf("expected valid to be %t for header %q and form %q", test.valid, test.header, test.form)
+		}
+	}
+}
+
+// TestLoginCSRF tests that the login form includes a CSRF token derived from
+// the login_csrf cookie, which logging in requires
+func TestLoginCSRF(t *testing.T) {
+	srv := NewServer(nil, nil, nil)
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/login", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected ok response, got %d", w.Code)
+	}
+	cookies := (&http.Response{Header: w.Header()}).Cookies()
+	if len(cookies) != 1 || cookies[0].Name != loginCSRFCookie || !cookies[0].HttpOnly {
+		t.Fatalf("expected an HttpOnly login CSRF cookie, got %v", cookies)
+	}
+	token := csrfToken(cookies[0].Value)
+	if !strings.Contains(w.Body.String(), `value="`+token+`"`) {
+		t.Fatalf("expected the login form to include the CSRF token, got %s", w.Body.String())
+	}
+
+	// an existing token is reused
+	req := httptest.NewRequest("GET", "http://example.com/login", nil)
+	req.AddCookie(cookies[0])
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	if w.Header().Get("Set-Cookie") != "" || !strings.Contains(w.Body.String(), `value="`+token+`"`) {
+		t.Fatal("expected the existing login CSRF token to be reused")
+	}
+
+	for _, test := range []struct {
+		desc   string
+		cookie bool
+		token  string
+	}{
+		{desc: "no cookie", token: token},
+		{desc: "no token", cookie: true},
+		{desc: "invalid token", cookie: true, token: csrfToken("other")},
+	} {
+		form := url.Values{"username": {"admin"}, "password": {"password"}, csrfField: {test.token}}
+		req := httptest.NewRequest("POST", "http://example.com/login", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if test.cookie {
+			req.AddCookie(cookies[0])
+		}
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		if w.Code != http.StatusForbidden {
+			t.Fatalf("%s: expected 403 response, got %d", test.desc, w.Code)
+		}
+	}
+}
+
+// TestCrossOrigin tests that requests which change state are rejected if
+// they come from an origin which is not allowed
+func TestCrossOrigin(t *testing.T) {
+	srv := newTestServer(nil, nil, nil)
+	srv.allowedOrigins = []string{"https://ci.example.com"}
+
+	for _, test := range []struct {
+		method  string
+		path    string
+		origin  string
+		status  int
+		allowed bool
+	}{
+		{method: "POST", path: "/logout", origin: "", status: http.StatusFound},
+		{method: "POST", path: "/logout", origin: "http://example.com", status: http.StatusFound, allowed: true},
+		{method: "POST", path: "/logout", origin: "https://ci.example.com", status: http.StatusFound, allowed: true},
+		{method: "POST", path: "/logout", origin: "https://evil.com", status: http.StatusForbidden},
+		{method: "POST", path: "/logout", origin: "null", status: http.StatusForbidden},
+		{method: "POST", path: "/login", origin: "https://evil.com", status: http.StatusForbidden},
+		{method: "PUT", path: "/repos/1", origin: "https://evil.com", status: http.StatusForbidden},
+		{method: "GET", path: "/login", origin: "https://evil.com", status: http.StatusOK},
+	} {
+		req := httptest.NewRequest(test.method, "http://example.com"+test.path, nil)
+		if test.origin != "" {
+			req.Header.Set("Origin", test.origin)
+		}
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		if w.Code != test.status {
+			t.Fatalf("expected %d response for %s %s from %q, got %d", test.status, test.method, test.path, test.origin, w.Code)
+		}
+		if allowed := w.Header().Get("Access-Control-Allow-Origin"); (allowed != "") != test.allowed {
+			t.Fatalf("expected CORS headers for %q to be %t, got %q", test.origin, test.allowed, allowed)
+		}
+	}
+
+	// preflight requests from other origins do not get CORS headers
+	req := httptest.NewRequest("OPTIONS", "http://example.com/repos", nil)
+	req.Header.Set("Origin", "https://evil.com")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	if allowed := w.Header().Get("Access-Control-Allow-Origin"); allowed != "" {
+		t.Fatalf("expected no CORS headers for a preflight request from another origin, got %q", allowed)
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/flynn/flynn/pkg/postgres"
+	"github.com/jackc/pgx"
+	"github.com/julienschmidt/httprouter"
+)
+
+// deliveryListLimit is the maximum number of deliveries returned by
+// GET /deliveries.
+const deliveryListLimit = 100
+
+// maxDeliveryBodySize is the maximum size of a webhook request body, which
+// is the limit of GitHub webhook payloads.
+const maxDeliveryBodySize = 25 << 20
+
+// defaultDeliveryRetention is how long deliveries are stored before being
+// pruned.
+const defaultDeliveryRetention = 30 * 24 * time.Hour
+
+// deliveryPruneInterval is how often deliveries older than the retention
+// period are pruned.
+const deliveryPruneInterval = time.Hour
+
+// Delivery is a webhook request along with the result of handling it.
+type Delivery struct {
+	ID             int32       `json:"id"`
+	Provider       string      `json:"provider"`
+	DeliveryID     string      `json:"delivery_id"`
+	Event          string      `json:"event"`
+	Header         http.Header `json:"headers,omitempty"`
+	Body           []byte      `json:"-"`
+	SignatureValid bool        `json:"signature_valid"`
+	StatusCode     int32       `json:"status_code"`
+	Response       string      `json:"response"`
+	DeployID       *int32      `json:"deploy_id,omitempty"`
+	ReplayOf       *int32      `json:"replay_of,omitempty"`
+	CreatedAt      *time.Time  `json:"created_at"`
+
+	// RepoIDs are the IDs of the repo rules whose secrets the delivery
+	// was sent with, which replays of the delivery are limited to
+	RepoIDs []int32 `json:"repo_ids,omitempty"`
+
+	// tx is set when replaying a delivery so that the replay and its
+	// deploys are stored in the same transaction as its audit event
+	tx *postgres.DBTx
+}
+
+// authenticatedRepos returns the repo rules which the delivery was sent
+// with the secret of, so that a webhook signed with the secret of one rule
+// cannot deploy the apps of other rules for the same repo.
+//
+// Replayed deliveries are limited to the rules which authenticated the
+// original delivery.
+func (d *Delivery) authenticatedRepos(repos []Repo) []Repo {
+	var authenticated []Repo
+	for _, repo := range repos {
+		if d.authenticates(repo.ID) {
+			authenticated = append(authenticated, repo)
+		} else {
+			log.Printf("skipping repo %d: webhook not signed with its secret\n", repo.ID)
+		}
+	}
+	return authenticated
+}
+
+// authenticates returns whether the delivery was sent with the secret of
+// the repo rule.
+func (d *Delivery) authenticates(repoID int32) bool {
+	for _, id := range d.RepoIDs {
+		if id == repoID {
+			return true
+		}
+	}
+	return false
+}
+
+// MarshalJSON includes the body as a string rather than the base64 encoding
+// used for []byte.
+func (d *Delivery) MarshalJSON() ([]byte, error) {
+	type delivery Delivery
+	var body *string
+	if d.Body != nil {
+		b := string(d.Body)
+		body = &b
+	}
+	return json.Marshal(&struct {
+		*delivery
+		Body *string `json:"body,omitempty"`
+	}{(*delivery)(d), body})
+}
+
+const deliverySummaryColumns = "id, provider, delivery_id, event, signature_valid, status_code, response, deploy_id, replay_of, repo_ids, created_at"
+
+func scanDeliverySummary(s postgres.Scanner) (*Delivery, error) {
+	d := &Delivery{}
+	return d, s.Scan(&d.ID, &d.Provider, &d.DeliveryID, &d.Event, &d.SignatureValid, &d.StatusCode, &d.Response, &d.DeployID, &d.ReplayOf, &d.RepoIDs, &d.CreatedAt)
+}
+
+const deliveryColumns = deliverySummaryColumns + ", headers, body"
+
+func scanDelivery(s postgres.Scanner) (*Delivery, error) {
+	d := &Delivery{}
+	return d, s.Scan(&d.ID, &d.Provider, &d.DeliveryID, &d.Event, &d.SignatureValid, &d.StatusCode, &d.Response, &d.DeployID, &d.ReplayOf, &d.RepoIDs, &d.CreatedAt, &d.Header, &d.Body)
+}
+
+// responseRecorder records the status code and body of a response while
+// writing it to the underlying http.ResponseWriter.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	r.body.Write(p)
+	return r.ResponseWriter.Write(p)
+}
+
+// processDelivery handles the delivery and stores it along with the
+// response which was sent, with any secret headers redacted.
+//
+// The body of a delivery which was not authenticated is not stored, since
+// it cannot be replayed and anyone can send one.
+func (s *Server) processDelivery(w http.ResponseWriter, d *Delivery) {
+	rec := &responseRecorder{ResponseWriter: w}
+	s.handleDelivery(rec, d)
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	d.StatusCode = int32(rec.status)
+	d.Response = rec.body.String()
+	body := d.Body
+	if !d.SignatureValid {
+		body = []byte{}
+	}
+	const query = `INSERT INTO deliveries (provider, delivery_id, event, headers, body, signature_valid, status_code, response, deploy_id, replay_of, repo_ids)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) RETURNING id, created_at`
+	args := []interface{}{d.Provider, d.DeliveryID, d.Event, redactHeader(d.Header), body, d.SignatureValid, d.StatusCode, d.Response, d.DeployID, d.ReplayOf, d.RepoIDs}
+	var row postgres.Scanner
+	if d.tx != nil {
+		row = d.tx.QueryRow(query, args...)
+	} else {
+		row = s.db.QueryRow(query, args...)
+	}
+	if err := row.Scan(&d.ID, &d.CreatedAt); err != nil {
+		log.Println("error storing delivery:", err)
+	}
+}
+
+// pruneDeliveries periodically deletes deliveries older than the retention
+// period.
+func (s *Server) pruneDeliveries() {
+	if s.deliveryRetention <= 0 {
+		return
+	}
+	for {
+		if err := s.deleteOldDeliveries(); err != nil {
+			log.Println("error pruning deliveries:", err)
+		}
+		time.Sleep(deliveryPruneInterval)
+	}
+}
+
+// deleteOldDeliveries deletes deliveries older than the retention period,
+// with replays of deleted deliveries being kept.
+func (s *Server) deleteOldDeliveries() error {
+	return s.db.Exec("DELETE FROM deliveries WHERE created_at < now() - $1 * interval '1 second'", s.deliveryRetention.Seconds())
+}
+
+// getDeliveries returns the recent deliveries, which are not limited to
+// particular apps so cannot be listed with API tokens restricted to apps.
+func (s *Server) getDeliveries(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	if !checkUnrestricted(w, req) {
+		return
+	}
+	rows, err := s.db.Query(fmt.Sprintf("SELECT %s FROM deliveries ORDER BY id DESC LIMIT %d", deliverySummaryColumns, deliveryListLimit))
+	if err != nil {
+		log.Println("error getting deliveries from db:", err)
+		http.Error(w, "error getting deliveries", 500)
+		return
+	}
+	deliveries := []*Delivery{}
+	for rows.Next() {
+		delivery, err := scanDeliverySummary(rows)
+		if err != nil {
+			rows.Close()
+			log.Println("error scanning db row:", err)
+			http.Error(w, "error getting deliveries", 500)
+			return
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("error scanning db rows:", err)
+		http.Error(w, "error getting deliveries", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+// loadDelivery loads the delivery with the ID in the request params,
+// writing an error response and returning nil if it cannot be loaded.
+func (s *Server) loadDelivery(w http.ResponseWriter, params httprouter.Params) *Delivery {
+	id, err := strconv.ParseInt(params.ByName("id"), 10, 32)
+	if err != nil {
+		http.Error(w, "invalid delivery id", 400)
+		return nil
+	}
+	delivery, err := scanDelivery(s.db.QueryRow("SELECT "+deliveryColumns+" FROM deliveries WHERE id = $1", int32(id)))
+	if err == pgx.ErrNoRows {
+		http.Error(w, "delivery not found", 404)
+		return nil
+	} else if err != nil {
+		log.Println("error getting delivery from db:", err)
+		http.Error(w, "error getting delivery", 500)
+		return nil
+	}
+	return delivery
+}
+
+func (s *Server) getDelivery(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	if !checkUnrestricted(w, req) {
+		return
+	}
+	delivery := s.loadDelivery(w, params)
+	if delivery == nil {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(delivery)
+}
+
+// replayDelivery handles a stored delivery again, storing the result as a
+// new delivery which is returned in the response.
+//
+// Only deliveries with a valid signature can be replayed, and the signature
+// is not checked again so that deliveries can be replayed after the secret
+// has been rotated. The replay only deploys the repo rules whose secrets the
+// original delivery was sent with.
+//
+// The replay and its deploys are stored in the same transaction as the
+// audit event, so nothing is deployed if the replay cannot be audited.
+func (s *Server) replayDelivery(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	if !checkUnrestricted(w, req) {
+		return
+	}
+	original := s.loadDelivery(w, params)
+	if original == nil {
+		return
+	}
+	if !original.SignatureValid {
+		http.Error(w, "cannot replay a delivery with an invalid signature", 400)
+		return
+	}
+	log.Printf("replaying delivery %d\n", original.ID)
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		log.Println("error starting db transaction:", err)
+		http.Error(w, "error storing replayed delivery", 500)
+		return
+	}
+	defer tx.Rollback()
+	replay := &Delivery{
+		Provider: original.Provider,
+		Event:    original.Event,
+		Header:   original.Header,
+		Body:     original.Body,
+		ReplayOf: &original.ID,
+		RepoIDs:  original.RepoIDs,
+		tx:       tx,
+	}
+	s.processDelivery(discardResponseWriter{make(http.Header)}, replay)
+	if replay.ID == 0 {
+		http.Error(w, "error storing replayed delivery", 500)
+		return
+	}
+	var apps []string
+	if replay.DeployID != nil {
+		if deploy, err := scanDeploy(tx.QueryRow("SELECT "+deployColumns+" FROM deploys WHERE id = $1", *replay.DeployID)); err == nil {
+			apps = []string{deploy.App}
+		}
+	}
+	if !s.commitAudited(w, req, tx, &AuditEvent{
+		Action:  AuditDeliveryReplay,
+		Apps:    apps,
+		Details: map[string]interface{}{"delivery_id": original.ID, "replay_id": replay.ID, "deploy_id": replay.DeployID},
+	}, "error recording replayed delivery") {
+		return
+	}
+	s.wakeDeployWorker()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(replay)
+}
+
+// discardResponseWriter is an http.ResponseWriter which discards the
+// response, used when replaying deliveries since the response is instead
+// recorded in the replayed delivery.
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (d discardResponseWriter) Header() http.Header         { return d.header }
+func (d discardResponseWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (d discardResponseWriter) WriteHeader(int)             {}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestDeliveryReplay tests that webhook deliveries are stored and can be
+// replayed
+func TestDeliveryReplay(t *testing.T) {
+	db, err := setupTestDB("flynn_webhook_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	secretToken := []byte("secret")
+	s := httptest.NewServer(newTestServer(db, nil, secretToken))
+	defer s.Close()
+
+	if err := db.Exec("INSERT INTO repos (name, branch, apps) VALUES ('lmars/foo', 'master', '{foo}')"); err != nil {
+		t.Fatal(err)
+	}
+
+	event := Event{
+		Ref:        "refs/heads/master",
+		HeadCommit: Commit{ID: "a1b2c3"},
+		Repository: Repository{FullName: "lmars/foo", CloneURL: "https://github.com/lmars/foo.git"},
+	}
+	for _, token := range [][]byte{secretToken, []byte("invalid")} {
+		req, err := newWebhookRequest(s.URL, "push", event, token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-GitHub-Delivery", "delivery-1")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+
+	res, err := http.Get(s.URL + "/deliveries")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var deliveries []*Delivery
+	if err := json.NewDecoder(res.Body).Decode(&deliveries); err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 2 {
+		t.Fatalf("expected 2 deliveries, got %d", len(deliveries))
+	}
+	invalid, valid := deliveries[0], deliveries[1]
+	if invalid.SignatureValid || invalid.StatusCode != 400 {
+		t.Fatalf("expected invalid delivery with status 400, got %+v", invalid)
+	}
+	if !valid.SignatureValid || valid.StatusCode != 200 || valid.DeployID == nil {
+		t.Fatalf("expected valid delivery with status 200 and a deploy, got %+v", valid)
+	}
+
+	replay := func(id int32) (*http.Response, *Delivery) {
+		res, err := http.Post(fmt.Sprintf("%s/deliveries/%d/replay", s.URL, id), "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return res, nil
+		}
+		var delivery Delivery
+		if err := json.NewDecoder(res.Body).Decode(&delivery); err != nil {
+			t.Fatal(err)
+		}
+		return res, &delivery
+	}
+
+	if res, _ := replay(invalid.ID); res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected replaying invalid delivery to fail, got %s", res.Status)
+	}
+
+	// the replay should queue a new deploy even though it duplicates
+	// the original delivery
+	_, replayed := replay(valid.ID)
+	if replayed.ReplayOf == nil || *replayed.ReplayOf != valid.ID {
+		t.Fatalf("expected replay of delivery %d, got %v", valid.ID, replayed.ReplayOf)
+	}
+	if replayed.DeployID == nil || *replayed.DeployID == *valid.DeployID {
+		t.Fatalf("expected replay to queue a new deploy, got %v", replayed.DeployID)
+	}
+
+	// generic deliveries can be replayed even though their bearer token
+	// is redacted when they are stored
+	if err := db.Exec("INSERT INTO repos (provider, name, branch, apps) VALUES ('generic', 'lmars/bar', 'master', '{bar}')"); err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("POST", s.URL, strings.NewReader(`{"repo":"lmars/bar","ref":"master","commit":"d4e5f6","clone_url":"https://git.example.com/lmars/bar.git"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer secret")
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected ok response to generic webhook, got %s", res.Status)
+	}
+	res, err = http.Get(s.URL + "/deliveries")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	deliveries = nil
+	if err := json.NewDecoder(res.Body).Decode(&deliveries); err != nil {
+		t.Fatal(err)
+	}
+	generic := deliveries[0]
+	if generic.Provider != "generic" || generic.DeployID == nil {
+		t.Fatalf("expected generic delivery with a deploy, got %+v", generic)
+	}
+	res, replayed = replay(generic.ID)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected replaying generic delivery to succeed, got %s", res.Status)
+	}
+	if replayed.Provider != "generic" || replayed.StatusCode != 200 || replayed.DeployID == nil || *replayed.DeployID == *generic.DeployID {
+		t.Fatalf("expected replay to queue a new deploy, got %+v", replayed)
+	}
+
+	// replays which cannot be audited do not queue a deploy
+	var deploys, count int
+	if err := db.QueryRow("SELECT count(*) FROM deploys").Scan(&deploys); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec("ALTER TABLE audit_events RENAME TO audit_events_old"); err != nil {
+		t.Fatal(err)
+	}
+	res, _ = replay(generic.ID)
+	if err := db.Exec("ALTER TABLE audit_events_old RENAME TO audit_events"); err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("expected replay to fail without an audit log, got %s", res.Status)
+	}
+	if err := db.QueryRow("SELECT count(*) FROM deploys").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != deploys {
+		t.Fatalf("expected no deploy to be queued by the failed replay, got %d new deploys", count-deploys)
+	}
+}
+
+// TestDeliveryStorageLimits tests that large request bodies are rejected,
+// that the bodies of unauthenticated deliveries are not stored and that old
+// deliveries are pruned
+func TestDeliveryStorageLimits(t *testing.T) {
+	db, err := setupTestDB("flynn_webhook_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	srv := newTestServer(db, nil, []byte("secret"))
+	s := httptest.NewServer(srv)
+	defer s.Close()
+
+	res, err := http.Post(s.URL, "application/json", strings.NewReader(strings.Repeat("a", maxDeliveryBodySize+1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected request entity too large response, got %s", res.Status)
+	}
+
+	event := Event{Ref: "refs/heads/master", Repository: Repository{FullName: "lmars/foo"}}
+	res, err = sendWebhook(s.URL, "push", event, []byte("invalid"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected bad request response, got %s", res.Status)
+	}
+	var size int
+	if err := db.QueryRow("SELECT length(body) FROM deliveries ORDER BY id DESC LIMIT 1").Scan(&size); err != nil {
+		t.Fatal(err)
+	}
+	if size != 0 {
+		t.Fatalf("expected unauthenticated body not to be stored, got %d bytes", size)
+	}
+
+	// old deliveries are pruned, keeping their recent replays
+	if err := db.Exec("UPDATE deliveries SET created_at = now() - interval '31 days'"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec("INSERT INTO deliveries (headers, body, status_code, replay_of) SELECT '{}', '', 200, max(id) FROM deliveries"); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.deleteOldDeliveries(); err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	if err := db.QueryRow("SELECT count(*) FROM deliveries").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatalf("expected only the recent delivery to be kept, got %d deliveries", count)
+	}
+}
@@ -0,0 +1,604 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/pkg/cluster"
+	"github.com/flynn/flynn/pkg/postgres"
+	"github.com/jackc/pgx"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	DeployStatePending = "pending"
+	DeployStateRunning = "running"
+	DeployStateSuccess = "success"
+	DeployStateFailure = "failure"
+	DeployStateSkipped = "skipped"
+)
+
+// deployPollInterval is how often the deploy worker checks the queue when
+// it has not been woken up by a new deploy, so that deploys queued by
+// other processes, or whose lease has expired, are still picked up.
+const deployPollInterval = 10 * time.Second
+
+// deployLeaseDuration is how long a worker holds the lease on a running
+// deploy without renewing it, after which the deploy is assumed to have
+// been interrupted (e.g. by the process stopping) and is run again.
+const deployLeaseDuration = time.Minute
+
+// deployLeaseRenewInterval is how often a worker renews the leases of its
+// running deploys.
+const deployLeaseRenewInterval = deployLeaseDuration / 3
+
+// defaultDedupWindow is how long a delivery ID or commit is remembered so
+// that redelivered webhooks do not trigger duplicate deploys.
+const defaultDedupWindow = time.Hour
+
+type Deploy struct {
+	ID           int32      `json:"id"`
+	RepoID       int32      `json:"repo_id"`
+	Provider     string     `json:"provider"`
+	Repo         string     `json:"repo"`
+	CloneURL     string     `json:"clone_url"`
+	App          string     `json:"app"`
+	Branch       string     `json:"branch"`
+	Tag          string     `json:"tag,omitempty"`
+	Commit       string     `json:"commit"`
+	BuildContext string     `json:"build_context,omitempty"`
+	DeliveryID   string     `json:"delivery_id,omitempty"`
+	State        string     `json:"state"`
+	ExitStatus   *int32     `json:"exit_status,omitempty"`
+	Error        *string    `json:"error,omitempty"`
+	SkipReason   string     `json:"skip_reason,omitempty"`
+	CreatedAt    *time.Time `json:"created_at"`
+	StartedAt    *time.Time `json:"started_at,omitempty"`
+	FinishedAt   *time.Time `json:"finished_at,omitempty"`
+}
+
+const deployColumns = "id, repo_id, provider, repo, clone_url, app, branch, tag, commit, build_context, delivery_id, state, exit_status, error, skip_reason, created_at, started_at, finished_at"
+
+// Finished returns whether the deploy has either succeeded, failed or was
+// skipped.
+func (d *Deploy) Finished() bool {
+	return d.State == DeployStateSuccess || d.State == DeployStateFailure || d.State == DeployStateSkipped
+}
+
+func scanDeploy(s postgres.Scanner) (*Deploy, error) {
+	d := &Deploy{}
+	return d, s.Scan(&d.ID, &d.RepoID, &d.Provider, &d.Repo, &d.CloneURL, &d.App, &d.Branch, &d.Tag, &d.Commit, &d.BuildContext, &d.DeliveryID, &d.State, &d.ExitStatus, &d.Error, &d.SkipReason, &d.CreatedAt, &d.StartedAt, &d.FinishedAt)
+}
+
+func (s *Server) getDeploy(id int32) (*Deploy, error) {
+	return scanDeploy(s.db.QueryRow("SELECT "+deployColumns+" FROM deploys WHERE id = $1", id))
+}
+
+// findDuplicateDeploy returns a deploy queued within the dedup window which
+// deploys the same branch or tag for the same repo rule to the same app and
+// either has the same delivery ID or deploys the same commit, or nil if
+// there is no such deploy.
+//
+// Deliveries are only matched for the same app since a delivery fans out to
+// a deploy per app.
+//
+// Tag deploys are matched by tag rather than commit since release events
+// do not include the commit, so a tag push followed by the release being
+// published only deploys once.
+func (s *Server) findDuplicateDeploy(tx *postgres.DBTx, d *Deploy) (*Deploy, error) {
+	dup, err := scanDeploy(tx.QueryRow(`
+SELECT `+deployColumns+` FROM deploys
+WHERE created_at > now() - $1 * interval '1 second'
+AND repo_id = $3 AND branch = $4 AND tag = $7 AND app = $6
+AND ((delivery_id <> '' AND delivery_id = $2) OR commit = $5 OR tag <> '')
+ORDER BY id DESC
+LIMIT 1`,
+		s.dedupWindow.Seconds(), d.DeliveryID, d.RepoID, d.Branch, d.Commit, d.App, d.Tag,
+	))
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	return dup, err
+}
+
+const insertDeploy = "INSERT INTO deploys (repo_id, provider, repo, clone_url, app, branch, tag, commit, build_context, delivery_id, state, skip_reason) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) RETURNING id, created_at"
+
+func (d *Deploy) insertArgs() []interface{} {
+	return []interface{}{d.RepoID, d.Provider, d.Repo, d.CloneURL, d.App, d.Branch, d.Tag, d.Commit, d.BuildContext, d.DeliveryID, d.State, d.SkipReason}
+}
+
+// queueDeploy adds the deploy to the queue and wakes up the deploy worker,
+// or just records it if it has been skipped.
+func (s *Server) queueDeploy(d *Deploy) error {
+	if d.State == "" {
+		d.State = DeployStatePending
+	}
+	if err := s.db.QueryRow(insertDeploy, d.insertArgs()...).Scan(&d.ID, &d.CreatedAt); err != nil {
+		return err
+	}
+	if d.State == DeployStatePending {
+		s.wakeDeployWorker()
+	}
+	return nil
+}
+
+// queueDeployTx adds the deploy to the queue in the transaction, with the
+// deploy worker needing to be woken up once it has been committed.
+func queueDeployTx(tx *postgres.DBTx, d *Deploy) error {
+	if d.State == "" {
+		d.State = DeployStatePending
+	}
+	return tx.QueryRow(insertDeploy, d.insertArgs()...).Scan(&d.ID, &d.CreatedAt)
+}
+
+// queueDeployUnlessDuplicate queues the deploy unless it duplicates a
+// deploy queued within the dedup window, in which case the duplicate is
+// returned.
+//
+// The check and insert are run in a transaction which holds an advisory
+// lock for the repo rule and app so that concurrent redeliveries of a
+// webhook do not both queue a deploy.
+func (s *Server) queueDeployUnlessDuplicate(d *Deploy) (*Deploy, error) {
+	if s.dedupWindow <= 0 {
+		return nil, s.queueDeploy(d)
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if err := tx.Exec("SELECT pg_advisory_xact_lock($1, hashtext($2))", d.RepoID, d.App); err != nil {
+		return nil, err
+	}
+	dup, err := s.findDuplicateDeploy(tx, d)
+	if err != nil || dup != nil {
+		return dup, err
+	}
+	if err := queueDeployTx(tx, d); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	if d.State == DeployStatePending {
+		s.wakeDeployWorker()
+	}
+	return nil, nil
+}
+
+// wakeDeployWorker wakes up the deploy worker without blocking if it is
+// already due to wake up.
+func (s *Server) wakeDeployWorker() {
+	select {
+	case s.deployCh <- struct{}{}:
+	default:
+	}
+}
+
+// claimDeploy marks the oldest deploy which is either pending or has an
+// expired lease as running with a lease held by this worker, and returns it.
+// Deploys for apps which have a deploy running with an unexpired lease are
+// skipped so that pushes to the same app are deployed in order.
+//
+// Claims are serialized across processes with an advisory lock held until
+// the claim is committed, so that two workers cannot both see an app as
+// idle. Logs of deploys being run again are deleted so that they only
+// contain the output of the new run.
+//
+// pgx.ErrNoRows is returned if there are no deploys to run.
+func (s *Server) claimDeploy() (*Deploy, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext('deploys'))"); err != nil {
+		return nil, err
+	}
+	var id int32
+	var state string
+	if err := tx.QueryRow(`
+SELECT id, state FROM deploys
+WHERE (state = 'pending' OR (state = 'running' AND lease_expires_at < now()))
+AND app NOT IN (SELECT app FROM deploys WHERE state = 'running' AND lease_expires_at >= now())
+ORDER BY id
+LIMIT 1
+FOR UPDATE`).Scan(&id, &state); err != nil {
+		return nil, err
+	}
+	if state == DeployStateRunning {
+		log.Printf("lease of deploy %d expired, running it again\n", id)
+		if err := tx.Exec("DELETE FROM deploy_logs WHERE deploy_id = $1", id); err != nil {
+			return nil, err
+		}
+	}
+	d, err := scanDeploy(tx.QueryRow(`
+UPDATE deploys SET state = 'running', started_at = now(), worker_id = $1, lease_expires_at = now() + $2 * interval '1 second'
+WHERE id = $3
+RETURNING `+deployColumns, s.workerID, deployLeaseDuration.Seconds(), id))
+	if err != nil {
+		return nil, err
+	}
+	return d, tx.Commit()
+}
+
+// renewDeployLease extends the lease on the running deploy, returning false
+// if the lease is no longer held by this worker.
+func (s *Server) renewDeployLease(id int32) (bool, error) {
+	err := s.db.QueryRow(
+		"UPDATE deploys SET lease_expires_at = now() + $1 * interval '1 second' WHERE id = $2 AND state = 'running' AND worker_id = $3 RETURNING id",
+		deployLeaseDuration.Seconds(), id, s.workerID,
+	).Scan(&id)
+	if err == pgx.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// runDeploys runs queued deploys until the process exits.
+//
+// Deploys which were running in a process which has stopped are run again
+// once their lease expires, while those still running in other processes
+// (e.g. the previous release while a new one is starting) are left alone.
+func (s *Server) runDeploys() {
+	for {
+		for {
+			d, err := s.claimDeploy()
+			if err == pgx.ErrNoRows {
+				break
+			} else if err != nil {
+				log.Println("error claiming deploy:", err)
+				break
+			}
+			go s.deploy(d)
+		}
+		select {
+		case <-s.deployCh:
+		case <-time.After(deployPollInterval):
+		}
+	}
+}
+
+// deploy runs the deploy and records the result, renewing its lease while it
+// runs and waking up the deploy worker once it finishes in case deploys for
+// the same app are waiting.
+func (s *Server) deploy(d *Deploy) {
+	done := make(chan struct{})
+	go s.renewDeployLeases(d.ID, done)
+	var exitStatus *int32
+	exit, err := s.runTaffy(d)
+	close(done)
+	if err == nil {
+		e := int32(exit)
+		exitStatus = &e
+		if exit != 0 {
+			err = fmt.Errorf("unexpected exit status: %d", exit)
+		}
+	}
+	state := DeployStateSuccess
+	var errMsg *string
+	if err != nil {
+		log.Printf("deploy %d failed: %s\n", d.ID, err)
+		state = DeployStateFailure
+		msg := err.Error()
+		errMsg = &msg
+	} else {
+		log.Printf("deploy %d complete\n", d.ID)
+	}
+	if err := s.finishDeploy(d.ID, state, exitStatus, errMsg); err != nil {
+		log.Printf("error updating deploy %d: %s\n", d.ID, err)
+	}
+	s.logBroker.finish(d.ID)
+	s.wakeDeployWorker()
+}
+
+// renewDeployLeases renews the lease on the running deploy until done is
+// closed.
+func (s *Server) renewDeployLeases(id int32, done chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(deployLeaseRenewInterval):
+		}
+		if held, err := s.renewDeployLease(id); err != nil {
+			log.Printf("error renewing lease of deploy %d: %s\n", id, err)
+		} else if !held {
+			log.Printf("lost lease of deploy %d\n", id)
+			return
+		}
+	}
+}
+
+// finishDeploy records the result of the deploy, unless its lease has been
+// taken over by another worker running it again.
+func (s *Server) finishDeploy(id int32, state string, exitStatus *int32, errMsg *string) error {
+	return s.db.Exec(
+		"UPDATE deploys SET state = $1, exit_status = $2, error = $3, finished_at = now(), lease_expires_at = NULL WHERE id = $4 AND state = 'running' AND worker_id = $5",
+		state, exitStatus, errMsg, id, s.workerID,
+	)
+}
+
+// runTaffy runs a taffy job for the deploy and returns the job's exit
+// status.
+//
+// Tag deploys pass the tag in place of the branch since taffy clones it
+// with "git clone --branch", which accepts either. Deploys with a build
+// context (e.g. of repos added with psql) fail rather than building the root
+// of the repo.
+func (s *Server) runTaffy(d *Deploy) (int, error) {
+	if d.BuildContext != "" {
+		return 0, errBuildContextUnsupported
+	}
+	branch := d.Branch
+	if d.Tag != "" {
+		branch = d.Tag
+	}
+	log.Printf("deploying app: %s, url: %s, branch: %s, commit: %s\n", d.App, d.CloneURL, branch, d.Commit)
+
+	taffyRelease, err := s.client.GetAppRelease("taffy")
+	if err != nil {
+		return 0, fmt.Errorf("error getting taffy release: %s", err)
+	}
+
+	job := &ct.NewJob{
+		ReleaseID:  taffyRelease.ID,
+		ReleaseEnv: true,
+		Args:       []string{"/bin/taffy", d.App, d.CloneURL, branch, d.Commit},
+	}
+	rwc, err := s.client.RunJobAttached("taffy", job)
+	if err != nil {
+		return 0, fmt.Errorf("error running job: %s", err)
+	}
+	stdout := s.newDeployLogWriter(d.ID, DeployLogStdout)
+	stderr := s.newDeployLogWriter(d.ID, DeployLogStderr)
+	defer stdout.Flush()
+	defer stderr.Flush()
+	attachClient := cluster.NewAttachClient(rwc)
+	exit, err := attachClient.Receive(stdout, stderr)
+	if err != nil {
+		return 0, fmt.Errorf("error running job: %s", err)
+	}
+	return exit, nil
+}
+
+// deployHistoryLimit is the maximum number of deploys returned by the
+// deploy history endpoints.
+const deployHistoryLimit = 100
+
+func (s *Server) getDeploys(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	s.serveDeploys(w, req, fmt.Sprintf("SELECT %s FROM deploys ORDER BY id DESC LIMIT %d", deployColumns, deployHistoryLimit))
+}
+
+func (s *Server) getRepoDeploys(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	id, err := strconv.ParseInt(params.ByName("id"), 10, 32)
+	if err != nil {
+		http.Error(w, "invalid repo id", 400)
+		return
+	}
+	s.serveDeploys(w, req, fmt.Sprintf("SELECT %s FROM deploys WHERE repo_id = $1 ORDER BY id DESC LIMIT %d", deployColumns, deployHistoryLimit), int32(id))
+}
+
+// deployRequest is the JSON body used to trigger deploys of a repo.
+type deployRequest struct {
+	Apps     []string `json:"apps"`
+	Branch   string   `json:"branch"`
+	Tag      string   `json:"tag"`
+	Commit   string   `json:"commit"`
+	CloneURL string   `json:"clone_url"`
+}
+
+// triggerDeploy queues deploys of a commit to the apps of a repo (or just
+// the given apps), for deploying without pushing. The branch defaults to
+// the repo's branch if it is not a pattern, and the clone URL defaults to
+// that of the repo's most recent deploy.
+func (s *Server) triggerDeploy(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	repo := s.loadRepo(w, params)
+	if repo == nil {
+		return
+	}
+	var r deployRequest
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		http.Error(w, "invalid JSON body", 400)
+		return
+	}
+	if len(r.Apps) == 0 {
+		r.Apps = repo.Apps
+	}
+	for _, app := range r.Apps {
+		if !repoHasApp(repo, app) {
+			http.Error(w, fmt.Sprintf("repo does not deploy to app %q", app), 400)
+			return
+		}
+	}
+	if !checkApps(w, req, ScopeDeploysTrigger, r.Apps...) {
+		return
+	}
+	if r.Commit == "" {
+		http.Error(w, "commit is required", 400)
+		return
+	}
+	ref := Ref{Type: RefTypeBranch, Name: r.Branch}
+	if r.Tag != "" {
+		ref = Ref{Type: RefTypeTag, Name: r.Tag}
+	} else if ref.Name == "" && patternKind(repo.Branch) == patternExact {
+		ref.Name = repo.Branch
+	}
+	if pattern := repo.Pattern(ref.Type); pattern == "" || !matchRefPattern(pattern, ref.Name) {
+		http.Error(w, fmt.Sprintf("%s does not match the repo", ref), 400)
+		return
+	}
+	if r.CloneURL == "" {
+		err := s.db.QueryRow("SELECT clone_url FROM deploys WHERE repo_id = $1 ORDER BY id DESC LIMIT 1", repo.ID).Scan(&r.CloneURL)
+		if err == pgx.ErrNoRows {
+			http.Error(w, "clone_url is required for repos which have not been deployed", 400)
+			return
+		} else if err != nil {
+			log.Println("error getting clone URL from db:", err)
+			http.Error(w, "error queueing deploy", 500)
+			return
+		}
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		log.Println("error starting db transaction:", err)
+		http.Error(w, "error queueing deploy", 500)
+		return
+	}
+	defer tx.Rollback()
+	deploys := make([]*Deploy, 0, len(r.Apps))
+	for _, app := range r.Apps {
+		deploy := &Deploy{
+			RepoID:       repo.ID,
+			Provider:     repo.Provider,
+			Repo:         repo.Name,
+			CloneURL:     r.CloneURL,
+			App:          app,
+			Commit:       r.Commit,
+			BuildContext: repo.BuildContext,
+		}
+		if ref.Type == RefTypeTag {
+			deploy.Tag = ref.Name
+		} else {
+			deploy.Branch = ref.Name
+		}
+		if err := queueDeployTx(tx, deploy); err != nil {
+			log.Println("error queueing deploy:", err)
+			http.Error(w, "error queueing deploy", 500)
+			return
+		}
+		deploys = append(deploys, deploy)
+	}
+	ids := make([]int32, len(deploys))
+	for i, deploy := range deploys {
+		ids[i] = deploy.ID
+	}
+	if !s.commitAudited(w, req, tx, &AuditEvent{
+		Action:  AuditDeployTrigger,
+		Apps:    r.Apps,
+		RepoID:  &repo.ID,
+		Details: map[string]interface{}{"deploy_ids": ids, "ref": ref.String(), "commit": r.Commit},
+	}, "error queueing deploy") {
+		return
+	}
+	for _, deploy := range deploys {
+		log.Printf("queued deploy %d of %s to %s\n", deploy.ID, ref, deploy.App)
+	}
+	s.wakeDeployWorker()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(deploys)
+}
+
+// rollbackDeploy queues a deploy of the same commit as a previous
+// successful deploy, to roll its app back to that commit.
+func (s *Server) rollbackDeploy(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	id, err := strconv.ParseInt(params.ByName("id"), 10, 32)
+	if err != nil {
+		http.Error(w, "invalid deploy id", 400)
+		return
+	}
+	previous, err := s.getDeploy(int32(id))
+	if err == pgx.ErrNoRows {
+		http.Error(w, "deploy not found", 404)
+		return
+	} else if err != nil {
+		log.Println("error getting deploy from db:", err)
+		http.Error(w, "error queueing deploy", 500)
+		return
+	}
+	if !checkApps(w, req, ScopeDeploysTrigger, previous.App) {
+		return
+	}
+	if previous.State != DeployStateSuccess {
+		http.Error(w, "can only roll back to a successful deploy", 400)
+		return
+	}
+	deploy := &Deploy{
+		RepoID:       previous.RepoID,
+		Provider:     previous.Provider,
+		Repo:         previous.Repo,
+		CloneURL:     previous.CloneURL,
+		App:          previous.App,
+		Branch:       previous.Branch,
+		Tag:          previous.Tag,
+		Commit:       previous.Commit,
+		BuildContext: previous.BuildContext,
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		log.Println("error starting db transaction:", err)
+		http.Error(w, "error queueing deploy", 500)
+		return
+	}
+	defer tx.Rollback()
+	if err := queueDeployTx(tx, deploy); err != nil {
+		log.Println("error queueing deploy:", err)
+		http.Error(w, "error queueing deploy", 500)
+		return
+	}
+	if !s.commitAudited(w, req, tx, &AuditEvent{
+		Action:  AuditDeployRollback,
+		Apps:    []string{deploy.App},
+		RepoID:  &deploy.RepoID,
+		Details: map[string]interface{}{"deploy_id": deploy.ID, "rollback_to": previous.ID, "commit": deploy.Commit},
+	}, "error queueing deploy") {
+		return
+	}
+	log.Printf("queued deploy %d rolling %s back to deploy %d\n", deploy.ID, deploy.App, previous.ID)
+	s.wakeDeployWorker()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(deploy)
+}
+
+func repoHasApp(repo *Repo, app string) bool {
+	for _, a := range repo.Apps {
+		if a == app {
+			return true
+		}
+	}
+	return false
+}
+
+// serveDeploys writes the deploys returned by the given query as JSON,
+// omitting deploys of apps which the caller cannot access.
+func (s *Server) serveDeploys(w http.ResponseWriter, req *http.Request, query string, args ...interface{}) {
+	previewRepos, err := s.previewRepos()
+	if err != nil {
+		log.Println("error getting repos from db:", err)
+		http.Error(w, "error getting deploys", 500)
+		return
+	}
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		log.Println("error getting deploys from db:", err)
+		http.Error(w, "error getting deploys", 500)
+		return
+	}
+	deploys := []*Deploy{}
+	for rows.Next() {
+		deploy, err := scanDeploy(rows)
+		if err != nil {
+			rows.Close()
+			log.Println("error scanning db row:", err)
+			http.Error(w, "error getting deploys", 500)
+			return
+		}
+		if requestCaller(req).CanAccessApps(ScopeDeploysRead, deploy.accessApp(previewRepos)) {
+			deploys = append(deploys, deploy)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("error scanning db rows:", err)
+		http.Error(w, "error getting deploys", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deploys)
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/pkg/postgres"
+	"github.com/flynn/flynn/pkg/sse"
+	"github.com/jackc/pgx"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	DeployLogStdout = "stdout"
+	DeployLogStderr = "stderr"
+)
+
+type DeployLogLine struct {
+	ID        int64     `json:"id"`
+	DeployID  int32     `json:"deploy_id"`
+	Stream    string    `json:"stream"`
+	Data      string    `json:"data"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func scanDeployLogLine(s postgres.Scanner) (*DeployLogLine, error) {
+	l := &DeployLogLine{}
+	return l, s.Scan(&l.ID, &l.DeployID, &l.Stream, &l.Data, &l.CreatedAt)
+}
+
+// DeployLogEvent is sent to clients following a deploy log, with Line set
+// for each line of output and Deploy set once the deploy has finished.
+type DeployLogEvent struct {
+	Line   *DeployLogLine `json:"line,omitempty"`
+	Deploy *Deploy        `json:"deploy,omitempty"`
+}
+
+// EventID implements the identifier interface used by sse.Stream so that
+// clients can resume following the log using the Last-Event-ID header.
+func (e *DeployLogEvent) EventID() string {
+	if e.Line == nil {
+		return ""
+	}
+	return strconv.FormatInt(e.Line.ID, 10)
+}
+
+// deployLogBroker distributes lines of deploy output to clients following
+// the logs of running deploys.
+type deployLogBroker struct {
+	mtx  sync.Mutex
+	subs map[int32]map[chan *DeployLogLine]struct{}
+}
+
+func newDeployLogBroker() *deployLogBroker {
+	return &deployLogBroker{subs: make(map[int32]map[chan *DeployLogLine]struct{})}
+}
+
+// subscribe returns a channel which receives lines of output for the given
+// deploy, and is closed either when the deploy finishes or if the
+// subscriber falls too far behind.
+func (b *deployLogBroker) subscribe(deployID int32) chan *DeployLogLine {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	ch := make(chan *DeployLogLine, 100)
+	if _, ok := b.subs[deployID]; !ok {
+		b.subs[deployID] = make(map[chan *DeployLogLine]struct{})
+	}
+	b.subs[deployID][ch] = struct{}{}
+	return ch
+}
+
+func (b *deployLogBroker) unsubscribe(deployID int32, ch chan *DeployLogLine) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if _, ok := b.subs[deployID][ch]; ok {
+		b.remove(deployID, ch)
+	}
+}
+
+// remove closes and removes the subscriber, and must be called with mtx
+// held.
+func (b *deployLogBroker) remove(deployID int32, ch chan *DeployLogLine) {
+	close(ch)
+	delete(b.subs[deployID], ch)
+	if len(b.subs[deployID]) == 0 {
+		delete(b.subs, deployID)
+	}
+}
+
+func (b *deployLogBroker) publish(line *DeployLogLine) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	for ch := range b.subs[line.DeployID] {
+		select {
+		case ch <- line:
+		default:
+			// the subscriber is not keeping up, so drop it rather
+			// than block the deploy (it can resume from the db)
+			b.remove(line.DeployID, ch)
+		}
+	}
+}
+
+// finish closes all subscribers of the given deploy.
+func (b *deployLogBroker) finish(deployID int32) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	for ch := range b.subs[deployID] {
+		b.remove(deployID, ch)
+	}
+}
+
+// deployLogWriter is an io.Writer which splits the output of a deploy into
+// lines, storing each line in the deploy_logs table and publishing it to
+// any clients following the log.
+type deployLogWriter struct {
+	db       *postgres.DB
+	broker   *deployLogBroker
+	deployID int32
+	stream   string
+	buf      []byte
+}
+
+func (s *Server) newDeployLogWriter(deployID int32, stream string) *deployLogWriter {
+	return &deployLogWriter{db: s.db, broker: s.logBroker, deployID: deployID, stream: stream}
+}
+
+// Write stores any complete lines in p, buffering a trailing partial line
+// until the next call to Write or Flush.
+//
+// Errors storing lines are logged rather than returned so that a database
+// error does not abort the deploy.
+func (w *deployLogWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.addLine(w.buf[:i])
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// Flush stores any remaining partial line.
+func (w *deployLogWriter) Flush() {
+	if len(w.buf) > 0 {
+		w.addLine(w.buf)
+		w.buf = nil
+	}
+}
+
+func (w *deployLogWriter) addLine(line []byte) {
+	// Postgres text values must be valid UTF-8 and cannot contain NUL
+	// bytes
+	data := strings.ToValidUTF8(string(bytes.TrimSuffix(line, []byte("\r"))), "\uFFFD")
+	data = strings.Replace(data, "\x00", "", -1)
+	l := &DeployLogLine{DeployID: w.deployID, Stream: w.stream, Data: data, CreatedAt: time.Now()}
+	if err := w.db.QueryRow(
+		"INSERT INTO deploy_logs (deploy_id, stream, data, created_at) VALUES ($1, $2, $3, $4) RETURNING id",
+		l.DeployID, l.Stream, l.Data, l.CreatedAt,
+	).Scan(&l.ID); err != nil {
+		log.Printf("error storing log line for deploy %d: %s\n", w.deployID, err)
+		return
+	}
+	w.broker.publish(l)
+}
+
+func (s *Server) getDeployLog(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	id, err := strconv.ParseInt(params.ByName("id"), 10, 32)
+	if err != nil {
+		http.Error(w, "invalid deploy id", 400)
+		return
+	}
+	deployID := int32(id)
+
+	deploy, err := s.getDeploy(deployID)
+	if err == pgx.ErrNoRows {
+		http.Error(w, "deploy not found", 404)
+		return
+	} else if err != nil {
+		log.Println("error getting deploy from db:", err)
+		http.Error(w, "error getting deploy log", 500)
+		return
+	}
+	previewRepos, err := s.previewRepos()
+	if err != nil {
+		log.Println("error getting repos from db:", err)
+		http.Error(w, "error getting deploy log", 500)
+		return
+	}
+	if !checkApps(w, req, ScopeDeploysRead, deploy.accessApp(previewRepos)) {
+		return
+	}
+
+	if req.FormValue("follow") == "true" {
+		s.followDeployLog(w, req, deployID)
+		return
+	}
+	lines, err := s.getDeployLogLines(deployID, 0)
+	if err != nil {
+		log.Println("error getting deploy log from db:", err)
+		http.Error(w, "error getting deploy log", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(lines)
+}
+
+// deployLogPollInterval is how often a followed deploy log is read from the
+// db when no lines have been published by this process, so that the output
+// of deploys run by other processes is still streamed.
+const deployLogPollInterval = time.Second
+
+// followDeployLog streams the deploy log as Server-Sent Events, sending
+// lines as they are stored (after the Last-Event-ID if set) followed by the
+// finished deploy.
+//
+// Lines are always read from the db, with lines published to the broker
+// only used to wake up the stream early, since the deploy may be running in
+// another process.
+func (s *Server) followDeployLog(w http.ResponseWriter, req *http.Request, deployID int32) {
+	var lastID int64
+	if h := req.Header.Get("Last-Event-ID"); h != "" {
+		var err error
+		lastID, err = strconv.ParseInt(h, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid Last-Event-ID header", 400)
+			return
+		}
+	}
+
+	// subscribe before loading the deploy so that no wake ups are missed
+	// between reading the stored lines and waiting for new ones
+	published := s.logBroker.subscribe(deployID)
+	defer s.logBroker.unsubscribe(deployID, published)
+
+	if _, err := s.getDeploy(deployID); err == pgx.ErrNoRows {
+		http.Error(w, "deploy not found", 404)
+		return
+	} else if err != nil {
+		log.Println("error getting deploy from db:", err)
+		http.Error(w, "error getting deploy log", 500)
+		return
+	}
+
+	ch := make(chan *DeployLogEvent)
+	stream := sse.NewStream(w, ch, nil)
+	stream.Serve()
+	send := func(e *DeployLogEvent) bool {
+		select {
+		case ch <- e:
+			return true
+		case <-stream.Done:
+			return false
+		}
+	}
+	go func() {
+		defer close(ch)
+		for {
+			// load the deploy before its lines so that all lines
+			// of a finished deploy are sent before the deploy
+			deploy, err := s.getDeploy(deployID)
+			if err != nil {
+				log.Println("error getting deploy from db:", err)
+				return
+			}
+			lines, err := s.getDeployLogLines(deployID, lastID)
+			if err != nil {
+				log.Println("error getting deploy log from db:", err)
+				return
+			}
+			for _, line := range lines {
+				if !send(&DeployLogEvent{Line: line}) {
+					return
+				}
+				lastID = line.ID
+			}
+			if deploy.Finished() {
+				send(&DeployLogEvent{Deploy: deploy})
+				return
+			}
+			select {
+			case _, ok := <-published:
+				if !ok {
+					// the broker closes the channel if we fall
+					// behind, so rely on polling from now on
+					published = nil
+				}
+				// the lines are read from the db, so drain any
+				// other pending wake ups
+				for len(published) > 0 {
+					<-published
+				}
+			case <-time.After(deployLogPollInterval):
+			case <-stream.Done:
+				return
+			}
+		}
+	}()
+	stream.Wait()
+}
+
+func (s *Server) getDeployLogLines(deployID int32, afterID int64) ([]*DeployLogLine, error) {
+	rows, err := s.db.Query("SELECT id, deploy_id, stream, data, created_at FROM deploy_logs WHERE deploy_id = $1 AND id > $2 ORDER BY id", deployID, afterID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	lines := []*DeployLogLine{}
+	for rows.Next() {
+		line, err := scanDeployLogLine(rows)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, line)
+	}
+	return lines, rows.Err()
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/flynn/flynn/pkg/sse"
+)
+
+// TestDeployLog tests that deploy output is stored line by line and can be
+// retrieved via the HTTP API
+func TestDeployLog(t *testing.T) {
+	db, err := setupTestDB("flynn_webhook_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	srv := newTestServer(db, nil, nil)
+	s := httptest.NewServer(srv)
+	defer s.Close()
+
+	deploy := &Deploy{RepoID: 1, Repo: "lmars/foo", App: "foo", Branch: "master", Commit: "a1"}
+	if err := srv.queueDeploy(deploy); err != nil {
+		t.Fatal(err)
+	}
+
+	stdout := srv.newDeployLogWriter(deploy.ID, DeployLogStdout)
+	stderr := srv.newDeployLogWriter(deploy.ID, DeployLogStderr)
+	stdout.Write([]byte("line 1\nli"))
+	stderr.Write([]byte("error\n"))
+	stdout.Write([]byte("ne 2\r\nline 3"))
+	stdout.Flush()
+
+	res, err := http.Get(fmt.Sprintf("%s/deploys/%d/log", s.URL, deploy.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected ok response, got %s", res.Status)
+	}
+	var lines []*DeployLogLine
+	if err := json.NewDecoder(res.Body).Decode(&lines); err != nil {
+		t.Fatal(err)
+	}
+	expected := []DeployLogLine{
+		{Stream: DeployLogStdout, Data: "line 1"},
+		{Stream: DeployLogStderr, Data: "error"},
+		{Stream: DeployLogStdout, Data: "line 2"},
+		{Stream: DeployLogStdout, Data: "line 3"},
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("expected %d lines, got %d", len(expected), len(lines))
+	}
+	for i, line := range lines {
+		if line.Stream != expected[i].Stream || line.Data != expected[i].Data {
+			t.Fatalf("expected line %d to be %s %q, got %s %q", i, expected[i].Stream, expected[i].Data, line.Stream, line.Data)
+		}
+	}
+
+	res, err = http.Get(s.URL + "/deploys/1000/log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected not found response, got %s", res.Status)
+	}
+}
+
+// TestDeployLogFollow tests that following the log of a finished deploy
+// replays the stored lines followed by the deploy
+func TestDeployLogFollow(t *testing.T) {
+	db, err := setupTestDB("flynn_webhook_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	srv := newTestServer(db, nil, nil)
+	s := httptest.NewServer(srv)
+	defer s.Close()
+
+	deploy := &Deploy{RepoID: 1, Repo: "lmars/foo", App: "foo", Branch: "master", Commit: "a1"}
+	if err := srv.queueDeploy(deploy); err != nil {
+		t.Fatal(err)
+	}
+	stdout := srv.newDeployLogWriter(deploy.ID, DeployLogStdout)
+	stdout.Write([]byte("line 1\nline 2\n"))
+	if err := db.Exec("UPDATE deploys SET state = 'success' WHERE id = $1", deploy.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := http.Get(fmt.Sprintf("%s/deploys/%d/log?follow=true", s.URL, deploy.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected ok response, got %s", res.Status)
+	}
+	dec := sse.NewDecoder(bufio.NewReader(res.Body))
+	for _, expected := range []string{"line 1", "line 2"} {
+		var event DeployLogEvent
+		if err := dec.Decode(&event); err != nil {
+			t.Fatal(err)
+		}
+		if event.Line == nil || event.Line.Data != expected {
+			t.Fatalf("expected line %q, got %+v", expected, event)
+		}
+	}
+	var event DeployLogEvent
+	if err := dec.Decode(&event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Deploy == nil || event.Deploy.State != DeployStateSuccess {
+		t.Fatalf("expected finished deploy, got %+v", event)
+	}
+}
+
+// TestDeployLogFollowRunning tests that following the log of a deploy which
+// is running in another process streams lines from the db even though they
+// are never published to the broker
+func TestDeployLogFollowRunning(t *testing.T) {
+	db, err := setupTestDB("flynn_webhook_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	srv := newTestServer(db, nil, nil)
+	s := httptest.NewServer(srv)
+	defer s.Close()
+
+	deploy := &Deploy{RepoID: 1, Repo: "lmars/foo", App: "foo", Branch: "master", Commit: "a1"}
+	if err := srv.queueDeploy(deploy); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec("UPDATE deploys SET state = 'running' WHERE id = $1", deploy.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := http.Get(fmt.Sprintf("%s/deploys/%d/log?follow=true", s.URL, deploy.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected ok response, got %s", res.Status)
+	}
+
+	// simulate another process running the deploy
+	if err := db.Exec("INSERT INTO deploy_logs (deploy_id, stream, data) VALUES ($1, 'stdout', 'line 1'), ($1, 'stdout', 'line 2')", deploy.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec("UPDATE deploys SET state = 'success' WHERE id = $1", deploy.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	events := make(chan *DeployLogEvent)
+	go func() {
+		defer close(events)
+		dec := sse.NewDecoder(bufio.NewReader(res.Body))
+		for {
+			var event DeployLogEvent
+			if err := dec.Decode(&event); err != nil {
+				return
+			}
+			events <- &event
+		}
+	}()
+	next := func() *DeployLogEvent {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				t.Fatal("expected event, stream closed")
+			}
+			return event
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for event")
+		}
+		return nil
+	}
+	for _, expected := range []string{"line 1", "line 2"} {
+		if event := next(); event.Line == nil || event.Line.Data != expected {
+			t.Fatalf("expected line %q, got %+v", expected, event)
+		}
+	}
+	if event := next(); event.Deploy == nil || event.Deploy.State != DeployStateSuccess {
+		t.Fatalf("expected finished deploy, got %+v", event)
+	}
+}
+
+// TestDeployLogBroker tests that published lines are received by
+// subscribers until the deploy finishes
+func TestDeployLogBroker(t *testing.T) {
+	b := newDeployLogBroker()
+	ch := b.subscribe(1)
+	other := b.subscribe(2)
+
+	b.publish(&DeployLogLine{ID: 1, DeployID: 1, Data: "line 1"})
+	b.finish(1)
+
+	if line, ok := <-ch; !ok || line.Data != "line 1" {
+		t.Fatalf(`expected line "line 1", got %+v`, line)
+	}
+	if _, ok := <-ch; ok {
+		t.Fatal("expected channel to be closed once the deploy finished")
+	}
+	select {
+	case line := <-other:
+		t.Fatalf("expected no lines for other deploy, got %+v", line)
+	default:
+	}
+	b.unsubscribe(2, other)
+	if len(b.subs) != 0 {
+		t.Fatalf("expected no subscribers, got %d", len(b.subs))
+	}
+}
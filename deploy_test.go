@@ -0,0 +1,336 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jackc/pgx"
+)
+
+// TestDeployHistory tests that deploys can be listed via the HTTP API
+func TestDeployHistory(t *testing.T) {
+	db, err := setupTestDB("flynn_webhook_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	srv := newTestServer(db, nil, nil)
+	s := httptest.NewServer(srv)
+	defer s.Close()
+
+	for _, d := range []*Deploy{
+		{RepoID: 1, Repo: "lmars/foo", App: "foo", Branch: "master", Commit: "a1"},
+		{RepoID: 2, Repo: "lmars/bar", App: "bar", Branch: "master", Commit: "b1"},
+		{RepoID: 1, Repo: "lmars/foo", App: "foo", Branch: "master", Commit: "a2"},
+	} {
+		if err := srv.queueDeploy(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Exec("UPDATE deploys SET state = 'failure', exit_status = 1 WHERE commit = 'a1'"); err != nil {
+		t.Fatal(err)
+	}
+
+	getDeploys := func(path string) []*Deploy {
+		res, err := http.Get(s.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("expected ok response, got %s", res.Status)
+		}
+		var deploys []*Deploy
+		if err := json.NewDecoder(res.Body).Decode(&deploys); err != nil {
+			t.Fatal(err)
+		}
+		return deploys
+	}
+
+	if deploys := getDeploys("/deploys.json"); len(deploys) != 3 {
+		t.Fatalf("expected 3 deploys, got %d", len(deploys))
+	}
+
+	deploys := getDeploys("/repos/1/deploys.json")
+	if len(deploys) != 2 {
+		t.Fatalf("expected 2 deploys, got %d", len(deploys))
+	}
+	if deploys[0].Commit != "a2" {
+		t.Fatalf(`expected most recent deploy first, got commit %q`, deploys[0].Commit)
+	}
+	failed := deploys[1]
+	if failed.State != DeployStateFailure {
+		t.Fatalf("expected deploy state %q, got %q", DeployStateFailure, failed.State)
+	}
+	if failed.ExitStatus == nil || *failed.ExitStatus != 1 {
+		t.Fatalf("expected exit status 1, got %v", failed.ExitStatus)
+	}
+}
+
+// TestTriggerDeploy tests that deploys of a repo can be triggered via the
+// HTTP API
+func TestTriggerDeploy(t *testing.T) {
+	db, err := setupTestDB("flynn_webhook_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	s := httptest.NewServer(newTestServer(db, newFakeAppClient("foo", "foo-worker", "bar"), nil))
+	defer s.Close()
+
+	var repo Repo
+	if _, err := sendJSON("POST", s.URL+"/repos", `{"name":"lmars/foo","apps":["foo","foo-worker"]}`, &repo); err != nil {
+		t.Fatal(err)
+	}
+	url := fmt.Sprintf("%s/repos/%d/deploys", s.URL, repo.ID)
+
+	for _, body := range []string{
+		`{"commit":"a1b2c3"}`,
+		`{"commit":"a1b2c3","branch":"develop","clone_url":"https://github.com/lmars/foo.git"}`,
+		`{"commit":"a1b2c3","tag":"v1.0.0","clone_url":"https://github.com/lmars/foo.git"}`,
+		`{"commit":"a1b2c3","apps":["bar"],"clone_url":"https://github.com/lmars/foo.git"}`,
+		`{"clone_url":"https://github.com/lmars/foo.git"}`,
+	} {
+		res, err := sendJSON("POST", url, body, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected 400 response for %s, got %s", body, res.Status)
+		}
+	}
+
+	var deploys []*Deploy
+	res, err := sendJSON("POST", url, `{"commit":"a1b2c3","clone_url":"https://github.com/lmars/foo.git"}`, &deploys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201 response, got %s", res.Status)
+	}
+	if len(deploys) != 2 || deploys[0].App != "foo" || deploys[1].App != "foo-worker" || deploys[0].Branch != "master" || deploys[0].State != DeployStatePending {
+		t.Fatalf("unexpected deploys: %+v", deploys)
+	}
+
+	// the clone URL defaults to that of the last deploy
+	res, err = sendJSON("POST", url, `{"commit":"d4e5f6","apps":["foo-worker"]}`, &deploys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201 response, got %s", res.Status)
+	}
+	if len(deploys) != 1 || deploys[0].App != "foo-worker" || deploys[0].CloneURL != "https://github.com/lmars/foo.git" {
+		t.Fatalf("unexpected deploys: %+v", deploys)
+	}
+}
+
+// TestRollbackDeploy tests that apps can be rolled back to the commit of a
+// previous successful deploy
+func TestRollbackDeploy(t *testing.T) {
+	db, err := setupTestDB("flynn_webhook_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	s := httptest.NewServer(newTestServer(db, nil, nil))
+	defer s.Close()
+
+	var success, failure int32
+	if err := db.QueryRow("INSERT INTO deploys (repo_id, provider, repo, clone_url, app, branch, commit, state) VALUES (1, 'github', 'lmars/foo', 'https://github.com/lmars/foo.git', 'foo', 'master', 'a1b2c3', 'success') RETURNING id").Scan(&success); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow("INSERT INTO deploys (repo_id, provider, repo, clone_url, app, branch, commit, state) VALUES (1, 'github', 'lmars/foo', 'https://github.com/lmars/foo.git', 'foo', 'master', 'd4e5f6', 'failure') RETURNING id").Scan(&failure); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := sendJSON("POST", fmt.Sprintf("%s/deploys/%d/rollback", s.URL, failure), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 response rolling back to a failed deploy, got %s", res.Status)
+	}
+
+	var deploy Deploy
+	res, err = sendJSON("POST", fmt.Sprintf("%s/deploys/%d/rollback", s.URL, success), "", &deploy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201 response, got %s", res.Status)
+	}
+	if deploy.ID == success || deploy.Commit != "a1b2c3" || deploy.App != "foo" || deploy.State != DeployStatePending {
+		t.Fatalf("unexpected deploy: %+v", deploy)
+	}
+}
+
+// TestClaimDeploy tests that deploys are claimed in order, with only one
+// deploy running for each app across workers
+func TestClaimDeploy(t *testing.T) {
+	db, err := setupTestDB("flynn_webhook_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	worker1 := newTestServer(db, nil, nil)
+	worker2 := newTestServer(db, nil, nil)
+	for _, d := range []*Deploy{
+		{RepoID: 1, Repo: "lmars/foo", App: "foo", Branch: "master", Commit: "a1"},
+		{RepoID: 1, Repo: "lmars/foo", App: "foo", Branch: "master", Commit: "a2"},
+		{RepoID: 2, Repo: "lmars/bar", App: "bar", Branch: "master", Commit: "b1"},
+	} {
+		if err := worker1.queueDeploy(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	claim := func(worker *Server, commit string) *Deploy {
+		d, err := worker.claimDeploy()
+		if commit == "" {
+			if err != pgx.ErrNoRows {
+				t.Fatalf("expected no deploy to be claimed, got %v (error: %v)", d, err)
+			}
+			return nil
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.Commit != commit || d.State != DeployStateRunning {
+			t.Fatalf("expected running deploy of %s, got %+v", commit, d)
+		}
+		return d
+	}
+
+	a1 := claim(worker1, "a1")
+	claim(worker2, "b1")
+	claim(worker2, "")
+	claim(worker1, "")
+
+	if err := worker1.finishDeploy(a1.ID, DeployStateSuccess, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	claim(worker2, "a2")
+}
+
+// TestClaimDeployConcurrently tests that workers claiming deploys at the same
+// time do not run more than one deploy for an app
+func TestClaimDeployConcurrently(t *testing.T) {
+	db, err := setupTestDB("flynn_webhook_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	const workers = 10
+	servers := make([]*Server, workers)
+	for i := range servers {
+		servers[i] = newTestServer(db, nil, nil)
+	}
+	for i := 0; i < workers; i++ {
+		d := &Deploy{RepoID: 1, Repo: "lmars/foo", App: "foo", Branch: "master", Commit: fmt.Sprintf("a%d", i)}
+		if err := servers[0].queueDeploy(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	errs := make(chan error, workers)
+	for _, s := range servers {
+		go func(s *Server) {
+			_, err := s.claimDeploy()
+			errs <- err
+		}(s)
+	}
+	claimed := 0
+	for i := 0; i < workers; i++ {
+		if err := <-errs; err == nil {
+			claimed++
+		} else if err != pgx.ErrNoRows {
+			t.Fatal(err)
+		}
+	}
+	if claimed != 1 {
+		t.Fatalf("expected 1 deploy to be claimed, got %d", claimed)
+	}
+	var running int
+	if err := db.QueryRow("SELECT COUNT(*) FROM deploys WHERE state = 'running'").Scan(&running); err != nil {
+		t.Fatal(err)
+	}
+	if running != 1 {
+		t.Fatalf("expected 1 running deploy, got %d", running)
+	}
+}
+
+// TestClaimDeployExpiredLease tests that running deploys are only run again
+// by another worker once their lease has expired, with the output of the
+// interrupted run being deleted
+func TestClaimDeployExpiredLease(t *testing.T) {
+	db, err := setupTestDB("flynn_webhook_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	worker1 := newTestServer(db, nil, nil)
+	if err := worker1.queueDeploy(&Deploy{RepoID: 1, Repo: "lmars/foo", App: "foo", Branch: "master", Commit: "a1"}); err != nil {
+		t.Fatal(err)
+	}
+	d, err := worker1.claimDeploy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := worker1.newDeployLogWriter(d.ID, DeployLogStdout)
+	stdout.Write([]byte("building\n"))
+
+	// a new process does not run the deploy while its lease is held
+	worker2 := newTestServer(db, nil, nil)
+	if _, err := worker2.claimDeploy(); err != pgx.ErrNoRows {
+		t.Fatalf("expected deploy with a held lease not to be claimed, got error %v", err)
+	}
+	if held, err := worker1.renewDeployLease(d.ID); err != nil || !held {
+		t.Fatalf("expected lease to be renewed, got %v (error: %v)", held, err)
+	}
+
+	if err := db.Exec("UPDATE deploys SET lease_expires_at = now() - interval '1 second' WHERE id = $1", d.ID); err != nil {
+		t.Fatal(err)
+	}
+	rerun, err := worker2.claimDeploy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rerun.ID != d.ID {
+		t.Fatalf("expected deploy %d to be run again, got %d", d.ID, rerun.ID)
+	}
+	var lines int
+	if err := db.QueryRow("SELECT COUNT(*) FROM deploy_logs WHERE deploy_id = $1", d.ID).Scan(&lines); err != nil {
+		t.Fatal(err)
+	}
+	if lines != 0 {
+		t.Fatalf("expected logs of the interrupted run to be deleted, got %d lines", lines)
+	}
+
+	// the first worker can no longer renew the lease or record a result
+	if held, err := worker1.renewDeployLease(d.ID); err != nil || held {
+		t.Fatalf("expected lease not to be renewed, got %v (error: %v)", held, err)
+	}
+	if err := worker1.finishDeploy(d.ID, DeployStateFailure, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := worker2.finishDeploy(d.ID, DeployStateSuccess, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	finished, err := worker2.getDeploy(d.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if finished.State != DeployStateSuccess {
+		t.Fatalf("expected deploy state %q, got %q", DeployStateSuccess, finished.State)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// giteaProvider handles webhooks sent by Gitea and Forgejo, which send a
+// GitHub style push payload signed with an HMAC-SHA256 X-Gitea-Signature
+// header.
+//
+// Forgejo also sends its headers with an X-Forgejo prefix, which are used if
+// the X-Gitea headers are missing.
+type giteaProvider struct{}
+
+// giteaHeader returns the value of the X-Gitea header with the given
+// suffix, falling back to the equivalent X-Forgejo header.
+func giteaHeader(h http.Header, suffix string) string {
+	if v := h.Get("X-Gitea-" + suffix); v != "" {
+		return v
+	}
+	return h.Get("X-Forgejo-" + suffix)
+}
+
+// giteaPushEvent is the payload of a Gitea "push" event.
+type giteaPushEvent struct {
+	Ref          string   `json:"ref"`
+	After        string   `json:"after"`
+	Commits      []Commit `json:"commits"`
+	TotalCommits int      `json:"total_commits"`
+	Repository   struct {
+		FullName string `json:"full_name"`
+		CloneURL string `json:"clone_url"`
+		HTMLURL  string `json:"html_url"`
+	} `json:"repository"`
+}
+
+func (giteaProvider) Name() string {
+	return "gitea"
+}
+
+func (giteaProvider) EventType(h http.Header) string {
+	return giteaHeader(h, "Event")
+}
+
+func (giteaProvider) DeliveryID(h http.Header) string {
+	return giteaHeader(h, "Delivery")
+}
+
+func (giteaProvider) RepoName(body []byte) string {
+	var event giteaPushEvent
+	json.Unmarshal(body, &event)
+	return event.Repository.FullName
+}
+
+func (giteaProvider) Authenticate(h http.Header, body []byte, secrets [][]byte) error {
+	sig := giteaHeader(h, "Signature")
+	if sig == "" {
+		return errors.New("missing X-Gitea-Signature header")
+	}
+	if !validHMAC(sig, "", sha256.New, body, secrets) {
+		return errors.New("invalid X-Gitea-Signature header")
+	}
+	return nil
+}
+
+func (giteaProvider) Events(eventType string, body []byte) ([]*Event, error) {
+	if eventType != "push" {
+		return nil, errors.New("unknown X-Gitea-Event: " + eventType)
+	}
+	var payload giteaPushEvent
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, errInvalidJSON
+	}
+	return []*Event{{
+		Ref: payload.Ref,
+		// Gitea indicates a deleted branch with an all zero after SHA
+		Deleted:    strings.Trim(payload.After, "0") == "",
+		HeadCommit: findCommit(payload.Commits, payload.After),
+		Commits:    payload.Commits,
+		Size:       payload.TotalCommits,
+		Repository: Repository{
+			FullName: payload.Repository.FullName,
+			CloneURL: payload.Repository.CloneURL,
+			URL:      payload.Repository.HTMLURL,
+		},
+	}}, nil
+}
+
+// genericProvider handles webhooks sent by CI systems or scripts using a
+// minimal JSON payload, authenticated with the secret sent as a bearer
+// token:
+//
+//	POST / HTTP/1.1
+//	Authorization: Bearer <secret>
+//	Content-Type: application/json
+//
+//	{
+//	  "repo":      "lmars/foo",
+//	  "ref":       "refs/heads/master",
+//	  "commit":    "da1560886d4f094c3e6c9ef40349f7d38b5d27d7",
+//	  "clone_url": "https://git.example.com/lmars/foo.git"
+//	}
+//
+// The ref may also be a plain branch name (e.g. "master"), and an optional
+// commit "message" is checked for skip directives.
+type genericProvider struct{}
+
+// genericPushEvent is the payload accepted by genericProvider.
+type genericPushEvent struct {
+	Repo     string `json:"repo"`
+	Ref      string `json:"ref"`
+	Commit   string `json:"commit"`
+	Message  string `json:"message"`
+	CloneURL string `json:"clone_url"`
+}
+
+// bearerToken returns the token from an "Authorization: Bearer" header.
+func bearerToken(h http.Header) string {
+	const prefix = "Bearer "
+	auth := h.Get("Authorization")
+	if !strings.HasPrefix(auth, prefix) {
+		return ""
+	}
+	return strings.TrimSpace(auth[len(prefix):])
+}
+
+func (genericProvider) Name() string {
+	return "generic"
+}
+
+// EventType returns "push" for any request with a bearer token, since the
+// generic provider only supports push events.
+func (genericProvider) EventType(h http.Header) string {
+	if bearerToken(h) == "" {
+		return ""
+	}
+	return "push"
+}
+
+func (genericProvider) DeliveryID(h http.Header) string {
+	return h.Get("X-Request-Id")
+}
+
+func (genericProvider) RepoName(body []byte) string {
+	var event genericPushEvent
+	json.Unmarshal(body, &event)
+	return event.Repo
+}
+
+func (genericProvider) Authenticate(h http.Header, body []byte, secrets [][]byte) error {
+	if !validToken(bearerToken(h), secrets) {
+		return errors.New("invalid bearer token")
+	}
+	return nil
+}
+
+func (genericProvider) Events(eventType string, body []byte) ([]*Event, error) {
+	var payload genericPushEvent
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, errInvalidJSON
+	}
+	if payload.Repo == "" || payload.Ref == "" || payload.Commit == "" || payload.CloneURL == "" {
+		return nil, errors.New("repo, ref, commit and clone_url are required")
+	}
+	ref := payload.Ref
+	if !strings.HasPrefix(ref, "refs/") {
+		ref = "refs/heads/" + ref
+	}
+	return []*Event{{
+		Ref:        ref,
+		HeadCommit: Commit{ID: payload.Commit, Message: payload.Message},
+		Repository: Repository{FullName: payload.Repo, CloneURL: payload.CloneURL},
+	}}, nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"testing"
+)
+
+const giteaPushPayload = `{
+  "ref": "refs/heads/master",
+  "before": "95790bf891e76fee5e1747ab589903a6a1f80f22",
+  "after": "da1560886d4f094c3e6c9ef40349f7d38b5d27d7",
+  "repository": {
+    "full_name": "lmars/foo",
+    "html_url": "https://gitea.example.com/lmars/foo",
+    "clone_url": "https://gitea.example.com/lmars/foo.git"
+  }
+}`
+
+// TestGiteaEvents tests that Gitea pushes are converted to push events and
+// authenticated using the X-Gitea-Signature header
+func TestGiteaEvents(t *testing.T) {
+	p := giteaProvider{}
+	body := []byte(giteaPushPayload)
+
+	if name := p.RepoName(body); name != "lmars/foo" {
+		t.Fatalf(`expected repo name "lmars/foo", got %q`, name)
+	}
+	events, err := p.Events("push", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(events))
+	}
+	event := events[0]
+	if event.Ref != "refs/heads/master" || event.Deleted || event.HeadCommit.ID != "da1560886d4f094c3e6c9ef40349f7d38b5d27d7" {
+		t.Fatalf("unexpected event: %+v", event)
+	}
+	if event.Repository.CloneURL != "https://gitea.example.com/lmars/foo.git" {
+		t.Fatalf("unexpected clone URL: %q", event.Repository.CloneURL)
+	}
+
+	secrets := [][]byte{[]byte("secret")}
+	for _, test := range []struct {
+		header http.Header
+		valid  bool
+	}{
+		{http.Header{"X-Gitea-Signature": {signBody(body, "", sha256.New, []byte("secret"))}}, true},
+		{http.Header{"X-Forgejo-Signature": {signBody(body, "", sha256.New, []byte("secret"))}}, true},
+		{http.Header{"X-Gitea-Signature": {signBody(body, "", sha256.New, []byte("invalid"))}}, false},
+		{http.Header{}, false},
+	} {
+		err := p.Authenticate(test.header, body, secrets)
+		if test.valid && err != nil {
+			t.Fatalf("expected %v to be valid, got error: %s", test.header, err)
+		} else if !test.valid && err == nil {
+			t.Fatalf("expected %v to be invalid", test.header)
+		}
+	}
+}
+
+// TestGenericEvents tests that generic payloads are converted to push
+// events and authenticated using a bearer token
+func TestGenericEvents(t *testing.T) {
+	p := genericProvider{}
+
+	for _, test := range []struct {
+		body string
+		ref  string
+	}{
+		{`{"repo":"lmars/foo","ref":"refs/heads/master","commit":"a1","clone_url":"https://git.example.com/lmars/foo.git"}`, "refs/heads/master"},
+		{`{"repo":"lmars/foo","ref":"develop","commit":"a1","clone_url":"https://git.example.com/lmars/foo.git"}`, "refs/heads/develop"},
+	} {
+		events, err := p.Events("push", []byte(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) != 1 {
+			t.Fatalf("expected 1 event, got %d", len(events))
+		}
+		event := events[0]
+		if event.Ref != test.ref || event.HeadCommit.ID != "a1" || event.Repository.FullName != "lmars/foo" {
+			t.Fatalf("unexpected event: %+v", event)
+		}
+	}
+	if _, err := p.Events("push", []byte(`{"repo":"lmars/foo","ref":"master"}`)); err == nil {
+		t.Fatal("expected error for payload without commit and clone_url")
+	}
+
+	secrets := [][]byte{[]byte("secret")}
+	if err := p.Authenticate(http.Header{"Authorization": {"Bearer secret"}}, nil, secrets); err != nil {
+		t.Fatalf("expected valid token, got error: %s", err)
+	}
+	if err := p.Authenticate(http.Header{"Authorization": {"Bearer invalid"}}, nil, secrets); err == nil {
+		t.Fatal("expected invalid token error")
+	}
+	if err := p.Authenticate(http.Header{"Authorization": {"Basic c2VjcmV0"}}, nil, secrets); err == nil {
+		t.Fatal("expected error for non bearer authorization")
+	}
+}
+
+// TestGiteaProviderDispatch tests that Gitea, Forgejo and generic webhooks
+// are dispatched to the correct provider
+func TestGiteaProviderDispatch(t *testing.T) {
+	s := newTestServer(nil, nil, nil)
+
+	// Gitea sends the same event with Gitea, Gogs and GitHub headers
+	gitea := http.Header{}
+	for _, prefix := range []string{"X-Gitea-", "X-Gogs-", "X-GitHub-"} {
+		gitea.Set(prefix+"Delivery", "f6266f16-1bf3-46a5-9ea4-602e06ead473")
+		gitea.Set(prefix+"Event", "push")
+		gitea.Set(prefix+"Event-Type", "push")
+	}
+	gitea.Set("X-Gitea-Signature", "sig")
+	gitea.Set("X-Gogs-Signature", "sig")
+	gitea.Set("X-Hub-Signature", "sha1=sig")
+	gitea.Set("X-Hub-Signature-256", "sha256=sig")
+
+	// Forgejo also sends Forgejo headers
+	forgejo := http.Header{}
+	for k, v := range gitea {
+		forgejo[k] = v
+	}
+	forgejo.Set("X-Forgejo-Delivery", "f6266f16-1bf3-46a5-9ea4-602e06ead473")
+	forgejo.Set("X-Forgejo-Event", "push")
+	forgejo.Set("X-Forgejo-Event-Type", "push")
+	forgejo.Set("X-Forgejo-Signature", "sig")
+
+	for _, test := range []struct {
+		header   http.Header
+		provider string
+	}{
+		{gitea, "gitea"},
+		{forgejo, "gitea"},
+		{http.Header{"X-Gitea-Event": {"push"}}, "gitea"},
+		{http.Header{"X-Forgejo-Event": {"push"}}, "gitea"},
+		{http.Header{"Authorization": {"Bearer secret"}}, "generic"},
+		{http.Header{"X-Github-Event": {"push"}, "Authorization": {"Bearer secret"}}, "github"},
+	} {
+		p, _ := s.findProvider(test.header)
+		if p == nil || p.Name() != test.provider {
+			t.Fatalf("expected provider %q, got %v", test.provider, p)
+		}
+	}
+	if p, _ := s.findProvider(http.Header{}); p != nil {
+		t.Fatalf("expected no provider, got %q", p.Name())
+	}
+}
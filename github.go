@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// githubProvider handles webhooks sent by GitHub, authenticated with an
+// HMAC signature of the payload.
+type githubProvider struct {
+	// allowSHA1 accepts webhooks which are only signed with the legacy
+	// HMAC-SHA1 X-Hub-Signature header
+	allowSHA1 bool
+}
+
+func (githubProvider) Name() string {
+	return "github"
+}
+
+func (githubProvider) EventType(h http.Header) string {
+	return h.Get("X-Github-Event")
+}
+
+func (githubProvider) DeliveryID(h http.Header) string {
+	return h.Get("X-GitHub-Delivery")
+}
+
+func (githubProvider) RepoName(body []byte) string {
+	var payload struct {
+		Repository Repository `json:"repository"`
+	}
+	json.Unmarshal(body, &payload)
+	return payload.Repository.FullName
+}
+
+func (p githubProvider) Authenticate(h http.Header, body []byte, secrets [][]byte) error {
+	return checkSignature(h, body, secrets, p.allowSHA1)
+}
+
+// githubReleaseEvent is the payload of a GitHub "release" event.
+type githubReleaseEvent struct {
+	Action  string `json:"action"`
+	Release struct {
+		TagName string `json:"tag_name"`
+	} `json:"release"`
+	Repository Repository `json:"repository"`
+}
+
+// githubPullRequestEvent is the payload of a GitHub "pull_request" event.
+type githubPullRequestEvent struct {
+	Action      string `json:"action"`
+	Number      int64  `json:"number"`
+	PullRequest struct {
+		Head struct {
+			Ref  string     `json:"ref"`
+			SHA  string     `json:"sha"`
+			Repo Repository `json:"repo"`
+		} `json:"head"`
+		Base struct {
+			Ref string `json:"ref"`
+		} `json:"base"`
+	} `json:"pull_request"`
+	Repository Repository `json:"repository"`
+}
+
+func (githubProvider) Events(eventType string, body []byte) ([]*Event, error) {
+	switch eventType {
+	case "ping":
+		return nil, errPing
+	case "push":
+		var event Event
+		if err := json.Unmarshal(body, &event); err != nil {
+			return nil, errInvalidJSON
+		}
+		return []*Event{&event}, nil
+	case "release":
+		var payload githubReleaseEvent
+		if err := json.Unmarshal(body, &payload); err != nil {
+			return nil, errInvalidJSON
+		}
+		// only deploy releases once they are published, ignoring
+		// drafts and edits
+		if payload.Action != "published" {
+			return nil, nil
+		}
+		// the payload does not include the tagged commit, so the tag
+		// is used as the commit to check out
+		return []*Event{{
+			Ref:        "refs/tags/" + payload.Release.TagName,
+			HeadCommit: Commit{ID: payload.Release.TagName},
+			Repository: payload.Repository,
+		}}, nil
+	case "pull_request":
+		var payload githubPullRequestEvent
+		if err := json.Unmarshal(body, &payload); err != nil {
+			return nil, errInvalidJSON
+		}
+		head := payload.PullRequest.Head
+		return []*Event{{
+			Ref:        "refs/heads/" + payload.PullRequest.Base.Ref,
+			HeadCommit: Commit{ID: head.SHA},
+			Repository: payload.Repository,
+			PullRequest: &PullRequest{
+				Number: payload.Number,
+				Action: payload.Action,
+				Branch: head.Ref,
+				Fork:   head.Repo.FullName != payload.Repository.FullName,
+			},
+		}}, nil
+	default:
+		return nil, errors.New("unknown X-Github-Event: " + eventType)
+	}
+}
+
+// checkSignature checks that the body was signed with one of the secrets
+// using the HMAC-SHA256 X-Hub-Signature-256 header, falling back to the
+// HMAC-SHA1 X-Hub-Signature header only if allowSHA1 is set.
+func checkSignature(h http.Header, body []byte, secrets [][]byte, allowSHA1 bool) error {
+	header, prefix, hash := "X-Hub-Signature-256", "sha256=", sha256.New
+	sigHeader := h.Get(header)
+	if sigHeader == "" {
+		if !allowSHA1 {
+			return errors.New("missing X-Hub-Signature-256 header")
+		}
+		header, prefix, hash = "X-Hub-Signature", "sha1=", sha1.New
+		sigHeader = h.Get(header)
+		if sigHeader == "" {
+			return errors.New("missing X-Hub-Signature-256 or X-Hub-Signature header")
+		}
+	}
+
+	if !validHMAC(sigHeader, prefix, hash, body, secrets) {
+		return errors.New("invalid " + header + " header")
+	}
+	return nil
+}
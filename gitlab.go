@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// gitlabProvider handles webhooks sent by GitLab, authenticated with the
+// secret token sent in the X-Gitlab-Token header.
+type gitlabProvider struct{}
+
+// gitlabPushEvent is the payload of a GitLab "Push Hook" or "Tag Push Hook"
+// event.
+type gitlabPushEvent struct {
+	Ref          string   `json:"ref"`
+	After        string   `json:"after"`
+	CheckoutSHA  *string  `json:"checkout_sha"`
+	Commits      []Commit `json:"commits"`
+	TotalCommits int      `json:"total_commits_count"`
+	Project      struct {
+		PathWithNamespace string `json:"path_with_namespace"`
+		GitHTTPURL        string `json:"git_http_url"`
+		WebURL            string `json:"web_url"`
+	} `json:"project"`
+}
+
+func (gitlabProvider) Name() string {
+	return "gitlab"
+}
+
+func (gitlabProvider) EventType(h http.Header) string {
+	return h.Get("X-Gitlab-Event")
+}
+
+func (gitlabProvider) DeliveryID(h http.Header) string {
+	return h.Get("X-Gitlab-Event-UUID")
+}
+
+func (gitlabProvider) RepoName(body []byte) string {
+	var event gitlabPushEvent
+	json.Unmarshal(body, &event)
+	return event.Project.PathWithNamespace
+}
+
+func (gitlabProvider) Authenticate(h http.Header, body []byte, secrets [][]byte) error {
+	token := h.Get("X-Gitlab-Token")
+	if token == "" {
+		return errors.New("missing X-Gitlab-Token header")
+	}
+	if !validToken(token, secrets) {
+		return errors.New("invalid X-Gitlab-Token header")
+	}
+	return nil
+}
+
+func (gitlabProvider) Events(eventType string, body []byte) ([]*Event, error) {
+	if eventType != "Push Hook" && eventType != "Tag Push Hook" {
+		return nil, errors.New("unknown X-Gitlab-Event: " + eventType)
+	}
+	var payload gitlabPushEvent
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, errInvalidJSON
+	}
+	event := &Event{
+		Ref: payload.Ref,
+		// GitLab indicates a deleted branch with a null checkout_sha
+		// and an all zero after SHA
+		Deleted: payload.CheckoutSHA == nil && strings.Trim(payload.After, "0") == "",
+		Commits: payload.Commits,
+		Size:    payload.TotalCommits,
+		Repository: Repository{
+			FullName: payload.Project.PathWithNamespace,
+			CloneURL: payload.Project.GitHTTPURL,
+			URL:      payload.Project.WebURL,
+		},
+	}
+	if payload.CheckoutSHA != nil {
+		event.HeadCommit = findCommit(payload.Commits, *payload.CheckoutSHA)
+	}
+	return []*Event{event}, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const gitlabPushPayload = `{
+  "object_kind": "push",
+  "before": "95790bf891e76fee5e1747ab589903a6a1f80f22",
+  "after": "da1560886d4f094c3e6c9ef40349f7d38b5d27d7",
+  "ref": "refs/heads/master",
+  "checkout_sha": "da1560886d4f094c3e6c9ef40349f7d38b5d27d7",
+  "project": {
+    "path_with_namespace": "lmars/foo",
+    "web_url": "https://gitlab.example.com/lmars/foo",
+    "git_http_url": "https://gitlab.example.com/lmars/foo.git"
+  }
+}`
+
+const gitlabDeletePayload = `{
+  "object_kind": "push",
+  "before": "95790bf891e76fee5e1747ab589903a6a1f80f22",
+  "after": "0000000000000000000000000000000000000000",
+  "ref": "refs/heads/feature",
+  "checkout_sha": null,
+  "project": {"path_with_namespace": "lmars/foo"}
+}`
+
+// TestGitlabEvents tests that GitLab push hooks are converted to push events
+func TestGitlabEvents(t *testing.T) {
+	p := gitlabProvider{}
+
+	events, err := p.Events("Push Hook", []byte(gitlabPushPayload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(events))
+	}
+	event := events[0]
+	if event.Ref != "refs/heads/master" || event.Deleted {
+		t.Fatalf("unexpected event: %+v", event)
+	}
+	if event.HeadCommit.ID != "da1560886d4f094c3e6c9ef40349f7d38b5d27d7" {
+		t.Fatalf("unexpected commit: %q", event.HeadCommit.ID)
+	}
+	if event.Repository.FullName != "lmars/foo" || event.Repository.CloneURL != "https://gitlab.example.com/lmars/foo.git" {
+		t.Fatalf("unexpected repository: %+v", event.Repository)
+	}
+
+	events, err = p.Events("Push Hook", []byte(gitlabDeletePayload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !events[0].Deleted {
+		t.Fatal("expected deleted branch event")
+	}
+
+	if _, err := p.Events("Issue Hook", []byte("{}")); err == nil {
+		t.Fatal("expected error for unknown event")
+	}
+
+	h := http.Header{"X-Gitlab-Token": {"secret"}}
+	if err := p.Authenticate(h, nil, [][]byte{[]byte("other"), []byte("secret")}); err != nil {
+		t.Fatalf("expected valid token, got error: %s", err)
+	}
+	if err := p.Authenticate(h, nil, [][]byte{[]byte("other")}); err == nil {
+		t.Fatal("expected invalid token")
+	}
+	if err := p.Authenticate(http.Header{}, nil, [][]byte{[]byte("secret")}); err == nil {
+		t.Fatal("expected missing token to be invalid")
+	}
+}
+
+// TestGitlabWebhook tests that GitLab push hooks deploy the GitLab repo
+// rather than a GitHub repo with the same name
+func TestGitlabWebhook(t *testing.T) {
+	db, err := setupTestDB("flynn_webhook_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	s := httptest.NewServer(newTestServer(db, nil, []byte("secret")))
+	defer s.Close()
+
+	if err := db.Exec("INSERT INTO repos (provider, name, branch, apps) VALUES ('github', 'lmars/foo', 'master', '{github-app}'), ('gitlab', 'lmars/foo', 'master', '{gitlab-app}')"); err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("POST", s.URL, strings.NewReader(gitlabPushPayload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Gitlab-Event", "Push Hook")
+	req.Header.Set("X-Gitlab-Token", "secret")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(res.Body)
+		t.Fatalf("expected ok response, got %s: %s", res.Status, body)
+	}
+
+	deploy, err := scanDeploy(db.QueryRow("SELECT " + deployColumns + " FROM deploys"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deploy.App != "gitlab-app" || deploy.Provider != "gitlab" {
+		t.Fatalf("expected deploy of gitlab-app, got %+v", deploy)
+	}
+
+	var header http.Header
+	if err := db.QueryRow("SELECT headers FROM deliveries").Scan(&header); err != nil {
+		t.Fatal(err)
+	}
+	if token := header.Get("X-Gitlab-Token"); token != "[redacted]" {
+		t.Fatalf("expected stored token to be redacted, got %q", token)
+	}
+}
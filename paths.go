@@ -0,0 +1,86 @@
+package main
+
+import (
+	"log"
+	"path"
+	"strings"
+)
+
+// changedFiles returns the paths of the files added, modified or removed by
+// the commits in the push event, which is empty if the provider does not
+// include them in the payload.
+//
+// It is also empty if the provider left some of the commits out of the
+// payload (e.g. GitLab only includes 20), since files changed by the missing
+// commits would not be included.
+func changedFiles(event *Event) []string {
+	if event.Size > len(event.Commits) {
+		log.Printf("not filtering push to %q by path: only %d of %d commits were sent\n", event.Repository.FullName, len(event.Commits), event.Size)
+		return nil
+	}
+	var files []string
+	seen := make(map[string]struct{})
+	for _, commit := range event.Commits {
+		for _, list := range [][]string{commit.Added, commit.Modified, commit.Removed} {
+			for _, file := range list {
+				if _, ok := seen[file]; !ok {
+					seen[file] = struct{}{}
+					files = append(files, file)
+				}
+			}
+		}
+	}
+	return files
+}
+
+// matchPath returns whether the file path matches the glob, either directly
+// or because the glob matches one of its parent directories (so "services/api"
+// and "services/*" both match "services/api/main.go"). A trailing "/**" is
+// accepted for readability and matches the same as the directory itself.
+func matchPath(glob, file string) bool {
+	glob = strings.TrimSuffix(glob, "/**")
+	for p := file; p != "." && p != "/" && p != ""; p = path.Dir(p) {
+		if matched, _ := path.Match(glob, p); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAnyPath returns whether the file path matches any of the globs.
+func matchAnyPath(globs []string, file string) bool {
+	for _, glob := range globs {
+		if matchPath(glob, file) {
+			return true
+		}
+	}
+	return false
+}
+
+// validPathGlob returns whether the path glob is valid.
+func validPathGlob(glob string) bool {
+	_, err := path.Match(strings.TrimSuffix(glob, "/**"), "")
+	return err == nil
+}
+
+// MatchPaths returns whether the changed files should trigger a deploy for
+// the repo rule, which is the case if any file matches one of the include
+// paths (or there are none) without matching an exclude path.
+//
+// Pushes without any changed files (e.g. tag pushes, or providers which do
+// not send the files changed) always match since they cannot be filtered.
+func (r Repo) MatchPaths(files []string) bool {
+	if len(files) == 0 || (len(r.IncludePaths) == 0 && len(r.ExcludePaths) == 0) {
+		return true
+	}
+	for _, file := range files {
+		if len(r.IncludePaths) > 0 && !matchAnyPath(r.IncludePaths, file) {
+			continue
+		}
+		if matchAnyPath(r.ExcludePaths, file) {
+			continue
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,85 @@
+package main
+
+import "testing"
+
+// TestMatchPath tests that path globs match files and the files in any
+// directory they match
+func TestMatchPath(t *testing.T) {
+	for _, test := range []struct {
+		glob    string
+		file    string
+		matched bool
+	}{
+		{"services/api", "services/api/main.go", true},
+		{"services/api", "services/api", true},
+		{"services/api", "services/api2/main.go", false},
+		{"services/*", "services/api/main.go", true},
+		{"services/api/**", "services/api/handlers/user.go", true},
+		{"*.md", "README.md", true},
+		{"*.md", "docs/README.md", false},
+		{"*/docs", "services/docs/index.md", true},
+		{"lib", "services/lib/foo.go", false},
+	} {
+		if matched := matchPath(test.glob, test.file); matched != test.matched {
+			t.Fatalf("expected %q matching %q to be %t, got %t", test.glob, test.file, test.matched, matched)
+		}
+	}
+}
+
+// TestRepoMatchPaths tests that repo rules only match pushes which change
+// included files which are not excluded
+func TestRepoMatchPaths(t *testing.T) {
+	repo := Repo{
+		IncludePaths: []string{"services/api", "lib"},
+		ExcludePaths: []string{"services/*/docs", "*.md"},
+	}
+	for _, test := range []struct {
+		files   []string
+		matched bool
+	}{
+		{[]string{"services/api/main.go"}, true},
+		{[]string{"services/web/main.go", "lib/util.go"}, true},
+		{[]string{"services/web/main.go"}, false},
+		{[]string{"services/api/docs/index.html"}, false},
+		{[]string{"README.md", "services/web/main.go"}, false},
+		{nil, true},
+	} {
+		if matched := repo.MatchPaths(test.files); matched != test.matched {
+			t.Fatalf("expected %v matching to be %t, got %t", test.files, test.matched, matched)
+		}
+	}
+
+	if !(Repo{}).MatchPaths([]string{"README.md"}) {
+		t.Fatal("expected repo without paths to match any files")
+	}
+	if !(Repo{ExcludePaths: []string{"docs"}}).MatchPaths([]string{"main.go"}) {
+		t.Fatal("expected repo with only exclude paths to match other files")
+	}
+}
+
+// TestChangedFiles tests that the files changed by all commits in a push
+// are collected without duplicates
+func TestChangedFiles(t *testing.T) {
+	event := &Event{Commits: []Commit{
+		{ID: "a1", Added: []string{"a.go"}, Modified: []string{"b.go"}},
+		{ID: "a2", Modified: []string{"a.go"}, Removed: []string{"c.go"}},
+	}}
+	files := changedFiles(event)
+	if len(files) != 3 || files[0] != "a.go" || files[1] != "b.go" || files[2] != "c.go" {
+		t.Fatalf("unexpected changed files: %v", files)
+	}
+
+	// pushes whose commits were truncated have no changed files so that
+	// they are not filtered
+	event.Size = 3
+	if files := changedFiles(event); files != nil {
+		t.Fatalf("expected no changed files for a push with missing commits, got %v", files)
+	}
+
+	// large pushes are filtered if all of their commits were sent
+	event = &Event{Commits: make([]Commit, 25), Size: 25}
+	event.Commits[0].Modified = []string{"a.go"}
+	if files := changedFiles(event); len(files) != 1 || files[0] != "a.go" {
+		t.Fatalf("unexpected changed files for a push with 25 commits: %v", files)
+	}
+}
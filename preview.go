@@ -0,0 +1,381 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn/controller/client"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/pkg/postgres"
+	router "github.com/flynn/flynn/router/types"
+	"github.com/jackc/pgx"
+	"github.com/julienschmidt/httprouter"
+)
+
+// PullRequest is set on events for pull requests, which deploy the head of
+// the pull request to a preview app for each repo rule with a preview
+// template which matches the base branch.
+type PullRequest struct {
+	Number int64
+	Action string
+
+	// Branch is the head branch of the pull request
+	Branch string
+
+	// Fork is whether the head branch is in a different repo, in which
+	// case no preview is deployed since the preview app would run
+	// untrusted code with a copy of the template app's env
+	Fork bool
+}
+
+const (
+	PullRequestOpened   = "opened"
+	PullRequestReopened = "reopened"
+	PullRequestUpdated  = "synchronize"
+	PullRequestClosed   = "closed"
+)
+
+// Preview is a throwaway app which a pull request is deployed to, created
+// from the repo rule's preview template app.
+type Preview struct {
+	ID        int32      `json:"id"`
+	RepoID    int32      `json:"repo_id"`
+	Provider  string     `json:"provider"`
+	Repo      string     `json:"repo"`
+	Number    int64      `json:"number"`
+	App       string     `json:"app"`
+	Template  string     `json:"template"`
+	Domain    string     `json:"domain,omitempty"`
+	CreatedAt *time.Time `json:"created_at"`
+}
+
+const previewColumns = "id, repo_id, provider, repo, number, app, template, domain, created_at"
+
+func scanPreview(s postgres.Scanner) (*Preview, error) {
+	p := &Preview{}
+	return p, s.Scan(&p.ID, &p.RepoID, &p.Provider, &p.Repo, &p.Number, &p.App, &p.Template, &p.Domain, &p.CreatedAt)
+}
+
+// previewAppName returns the name of the preview app of a pull request for
+// the repo rule, which includes the rule ID since several rules may have the
+// same preview template.
+func previewAppName(repo Repo, number int64) string {
+	return fmt.Sprintf("%s-%d-pr-%d", repo.PreviewTemplate, repo.ID, number)
+}
+
+// handlePullRequest deploys the pull request to its preview apps when it is
+// opened or updated, and deletes them when it is closed, writing the outcome
+// to the response.
+func (s *Server) handlePullRequest(w http.ResponseWriter, d *Delivery, provider Provider, event *Event) {
+	pr := event.PullRequest
+	switch pr.Action {
+	case PullRequestOpened, PullRequestReopened, PullRequestUpdated:
+		s.deployPreviews(w, d, provider, event)
+	case PullRequestClosed:
+		if err := s.deletePreviews(w, d, provider.Name(), event.Repository.FullName, pr.Number); err != nil {
+			log.Printf("error deleting preview apps for pull request %d: %s\n", pr.Number, err)
+			http.Error(w, "error deleting preview app", 500)
+		}
+	default:
+		log.Printf("ignoring %q action for pull request %d\n", pr.Action, pr.Number)
+	}
+}
+
+// deployPreviews deploys the pull request to a preview app for each repo
+// rule with a preview template which matches its base branch.
+//
+// Preview rules are matched regardless of other rules deploying the
+// template app, since the pull request is deployed to its own app.
+func (s *Server) deployPreviews(w http.ResponseWriter, d *Delivery, provider Provider, event *Event) {
+	pr := event.PullRequest
+	if pr.Fork {
+		log.Printf("skipping preview of pull request %d from a fork\n", pr.Number)
+		fmt.Fprintf(w, "skipping preview of pull request %d from a fork\n", pr.Number)
+		return
+	}
+	base, ok := parseRef(event.Ref)
+	if !ok {
+		log.Println("skipping pull request with unsupported base ref:", event.Ref)
+		return
+	}
+	matched, err := s.matchingRepos(provider.Name(), event.Repository.FullName, base, nil)
+	if err != nil {
+		log.Printf("error loading repos %q (%s): %s\n", event.Repository.FullName, base, err)
+		http.Error(w, "error loading repos", 500)
+		return
+	}
+	var repos []Repo
+	for _, repo := range matched {
+		if repo.PreviewTemplate != "" {
+			repos = append(repos, repo)
+		}
+	}
+	repos = d.authenticatedRepos(repos)
+	if len(repos) == 0 {
+		log.Printf("no repos with previews match %q (%s)\n", event.Repository.FullName, base)
+		return
+	}
+
+	head := Ref{Type: RefTypeBranch, Name: pr.Branch}
+	for _, repo := range repos {
+		preview, created, err := s.ensurePreview(repo, pr.Number)
+		if err != nil {
+			log.Printf("error creating preview app for pull request %d: %s\n", pr.Number, err)
+			http.Error(w, "error creating preview app", 500)
+			return
+		}
+		// a new preview app is always deployed, even if it is for a
+		// pull request which was closed and reopened without being
+		// updated
+		s.queueEventDeploy(w, d, repo, preview.App, head, event, d.ReplayOf == nil && !created)
+	}
+}
+
+// ensurePreview returns the preview of the pull request for the repo rule,
+// creating the preview app if it does not exist, and whether it was created.
+//
+// The preview is claimed by storing it before the app is created so that
+// concurrent events for the same pull request do not both try to create
+// it, and is deleted if the app cannot be created.
+func (s *Server) ensurePreview(repo Repo, number int64) (*Preview, bool, error) {
+	preview := &Preview{
+		RepoID:   repo.ID,
+		Provider: repo.Provider,
+		Repo:     repo.Name,
+		Number:   number,
+		App:      previewAppName(repo, number),
+		Template: repo.PreviewTemplate,
+	}
+	err := s.db.QueryRow(
+		"INSERT INTO previews (repo_id, provider, repo, number, app, template) VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (repo_id, number) DO NOTHING RETURNING id, created_at",
+		preview.RepoID, preview.Provider, preview.Repo, preview.Number, preview.App, preview.Template,
+	).Scan(&preview.ID, &preview.CreatedAt)
+	if err == pgx.ErrNoRows {
+		existing, err := scanPreview(s.db.QueryRow("SELECT "+previewColumns+" FROM previews WHERE repo_id = $1 AND number = $2", repo.ID, number))
+		return existing, false, err
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	domain, err := s.createPreviewApp(preview.App, preview.Template)
+	if err != nil {
+		if err := s.db.Exec("DELETE FROM previews WHERE id = $1", preview.ID); err != nil {
+			log.Printf("error deleting preview %d: %s\n", preview.ID, err)
+		}
+		return nil, false, err
+	}
+	preview.Domain = domain
+	if err := s.db.Exec("UPDATE previews SET domain = $1 WHERE id = $2", domain, preview.ID); err != nil {
+		return nil, false, err
+	}
+	log.Printf("created preview app %s from %s\n", preview.App, preview.Template)
+	return preview, true, nil
+}
+
+// createPreviewApp creates an app with a copy of the env and resources of
+// the template app, and a route if a domain can be determined, returning
+// the domain of the route.
+//
+// The app is deleted if any step fails so that it can be created again by
+// a later event.
+func (s *Server) createPreviewApp(name, templateName string) (domain string, err error) {
+	template, err := s.client.GetApp(templateName)
+	if err != nil {
+		return "", fmt.Errorf("error getting template app %s: %s", templateName, err)
+	}
+	app := &ct.App{
+		Name: name,
+		Meta: map[string]string{
+			"webhook-deploy-preview":  "true",
+			"webhook-deploy-template": template.Name,
+		},
+	}
+	if err := s.client.CreateApp(app); err != nil {
+		return "", fmt.Errorf("error creating app: %s", err)
+	}
+	defer func() {
+		if err != nil {
+			if _, err := s.client.DeleteApp(app.ID); err != nil {
+				log.Printf("error deleting app %s: %s\n", app.Name, err)
+			}
+		}
+	}()
+
+	env := make(map[string]string)
+	release, err := s.client.GetAppRelease(template.ID)
+	if err == nil {
+		for k, v := range release.Env {
+			env[k] = v
+		}
+	} else if err != controller.ErrNotFound {
+		return "", fmt.Errorf("error getting template release: %s", err)
+	}
+
+	// provision new resources rather than sharing the template's, with
+	// their env replacing the template resource env
+	resources, err := s.client.AppResourceList(template.ID)
+	if err != nil {
+		return "", fmt.Errorf("error getting template resources: %s", err)
+	}
+	for _, r := range resources {
+		resource, err := s.client.ProvisionResource(&ct.ResourceReq{ProviderID: r.ProviderID, Apps: []string{app.ID}})
+		if err != nil {
+			return "", fmt.Errorf("error provisioning resource: %s", err)
+		}
+		for k, v := range resource.Env {
+			env[k] = v
+		}
+	}
+
+	if len(env) > 0 {
+		release := &ct.Release{Env: env}
+		if err := s.client.CreateRelease(release); err != nil {
+			return "", fmt.Errorf("error creating release: %s", err)
+		}
+		if err := s.client.SetAppRelease(app.ID, release.ID); err != nil {
+			return "", fmt.Errorf("error setting release: %s", err)
+		}
+	}
+
+	domain, err = s.previewDomain(template, app.Name)
+	if err != nil {
+		return "", err
+	}
+	if domain != "" {
+		route := router.HTTPRoute{Domain: domain, Service: app.Name + "-web"}.ToRoute()
+		if err := s.client.CreateRoute(app.ID, route); err != nil {
+			return "", fmt.Errorf("error creating route: %s", err)
+		}
+	}
+	return domain, nil
+}
+
+// previewDomain returns the domain to route to a preview app, which is
+// either a subdomain of PREVIEW_DOMAIN or, if that is not set, the domain
+// of the template app's first HTTP route with the first label replaced by
+// the app name (e.g. foo-pr-1.example.com for foo.example.com). It returns
+// an empty string if the template app has no HTTP routes.
+func (s *Server) previewDomain(template *ct.App, name string) (string, error) {
+	if s.previewDomainSuffix != "" {
+		return name + "." + s.previewDomainSuffix, nil
+	}
+	routes, err := s.client.RouteList(template.ID)
+	if err != nil {
+		return "", fmt.Errorf("error getting template routes: %s", err)
+	}
+	for _, route := range routes {
+		if route.Type != "http" {
+			continue
+		}
+		if i := strings.Index(route.Domain, "."); i > 0 {
+			return name + route.Domain[i:], nil
+		}
+	}
+	return "", nil
+}
+
+// deletePreviews deletes the preview apps of the pull request, looking them
+// up by repo rather than by the rules which currently match so that previews
+// are still deleted if their rule has since been changed or deleted.
+//
+// Only the previews of rules which the delivery was sent with the secret of
+// are deleted, along with those of rules which no longer exist.
+func (s *Server) deletePreviews(w http.ResponseWriter, d *Delivery, provider, name string, number int64) error {
+	rows, err := s.db.Query("SELECT "+previewColumns+" FROM previews WHERE provider = $1 AND repo = $2 AND number = $3 AND (repo_id = ANY($4) OR repo_id NOT IN (SELECT id FROM repos)) ORDER BY id", provider, name, number, d.RepoIDs)
+	if err != nil {
+		return err
+	}
+	var previews []*Preview
+	for rows.Next() {
+		preview, err := scanPreview(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		previews = append(previews, preview)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(previews) == 0 {
+		log.Printf("no previews of %q pull request %d\n", name, number)
+		return nil
+	}
+	for _, preview := range previews {
+		if _, err := s.client.DeleteApp(preview.App); err != nil && err != controller.ErrNotFound {
+			return err
+		}
+		if err := s.db.Exec("DELETE FROM previews WHERE id = $1", preview.ID); err != nil {
+			return err
+		}
+		log.Printf("deleted preview app %s\n", preview.App)
+		fmt.Fprintf(w, "preview app %s deleted\n", preview.App)
+	}
+	return nil
+}
+
+// previewRepos returns the repo rules which have a preview template, keyed
+// by ID.
+func (s *Server) previewRepos() (map[int32]Repo, error) {
+	rows, err := s.db.Query("SELECT " + repoColumns + " FROM repos WHERE preview_template <> ''")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	repos := make(map[int32]Repo)
+	for rows.Next() {
+		repo, err := scanRepo(rows)
+		if err != nil {
+			return nil, err
+		}
+		repos[repo.ID] = repo
+	}
+	return repos, rows.Err()
+}
+
+// accessApp returns the app which access to the deploy is checked against,
+// which for deploys to preview apps of the given preview repo rules is the
+// template app (like in getPreviews) since roles do not cover preview apps.
+func (d *Deploy) accessApp(previewRepos map[int32]Repo) string {
+	repo, ok := previewRepos[d.RepoID]
+	if !ok || repoHasApp(&repo, d.App) {
+		return d.App
+	}
+	if strings.HasPrefix(d.App, fmt.Sprintf("%s-%d-pr-", repo.PreviewTemplate, repo.ID)) {
+		return repo.PreviewTemplate
+	}
+	return d.App
+}
+
+func (s *Server) getPreviews(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	rows, err := s.db.Query("SELECT " + previewColumns + " FROM previews ORDER BY id DESC")
+	if err != nil {
+		log.Println("error getting previews from db:", err)
+		http.Error(w, "error getting previews", 500)
+		return
+	}
+	previews := []*Preview{}
+	for rows.Next() {
+		preview, err := scanPreview(rows)
+		if err != nil {
+			rows.Close()
+			log.Println("error scanning db row:", err)
+			http.Error(w, "error getting previews", 500)
+			return
+		}
+		if requestCaller(req).CanAccessApps(ScopeDeploysRead, preview.Template) {
+			previews = append(previews, preview)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("error scanning db rows:", err)
+		http.Error(w, "error getting previews", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(previews)
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/flynn/flynn/controller/client"
+	ct "github.com/flynn/flynn/controller/types"
+	router "github.com/flynn/flynn/router/types"
+)
+
+// fakePreviewClient implements the controller client methods used to
+// create preview apps, recording the apps, releases and routes created
+type fakePreviewClient struct {
+	controller.Client
+
+	apps      map[string]*ct.App
+	releases  map[string]*ct.Release
+	resources map[string][]*ct.Resource
+	routes    map[string][]*router.Route
+	deleted   []string
+	failRoute bool
+}
+
+func newFakePreviewClient() *fakePreviewClient {
+	return &fakePreviewClient{
+		apps:      make(map[string]*ct.App),
+		releases:  make(map[string]*ct.Release),
+		resources: make(map[string][]*ct.Resource),
+		routes:    make(map[string][]*router.Route),
+	}
+}
+
+func (c *fakePreviewClient) GetApp(id string) (*ct.App, error) {
+	for _, app := range c.apps {
+		if app.ID == id || app.Name == id {
+			return app, nil
+		}
+	}
+	return nil, controller.ErrNotFound
+}
+
+func (c *fakePreviewClient) CreateApp(app *ct.App) error {
+	app.ID = app.Name + "-id"
+	c.apps[app.ID] = app
+	return nil
+}
+
+func (c *fakePreviewClient) DeleteApp(id string) (*ct.AppDeletion, error) {
+	c.deleted = append(c.deleted, id)
+	return &ct.AppDeletion{AppID: id}, nil
+}
+
+func (c *fakePreviewClient) GetAppRelease(appID string) (*ct.Release, error) {
+	app, ok := c.apps[appID]
+	if !ok || app.ReleaseID == "" {
+		return nil, controller.ErrNotFound
+	}
+	return c.releases[app.ReleaseID], nil
+}
+
+func (c *fakePreviewClient) CreateRelease(release *ct.Release) error {
+	release.ID = fmt.Sprintf("release-%d", len(c.releases))
+	c.releases[release.ID] = release
+	return nil
+}
+
+func (c *fakePreviewClient) SetAppRelease(appID, releaseID string) error {
+	c.apps[appID].ReleaseID = releaseID
+	return nil
+}
+
+func (c *fakePreviewClient) AppResourceList(appID string) ([]*ct.Resource, error) {
+	return c.resources[appID], nil
+}
+
+func (c *fakePreviewClient) ProvisionResource(req *ct.ResourceReq) (*ct.Resource, error) {
+	resource := &ct.Resource{ProviderID: req.ProviderID, Apps: req.Apps, Env: map[string]string{"DATABASE_URL": "postgres://" + req.Apps[0]}}
+	for _, app := range req.Apps {
+		c.resources[app] = append(c.resources[app], resource)
+	}
+	return resource, nil
+}
+
+func (c *fakePreviewClient) RouteList(appID string) ([]*router.Route, error) {
+	return c.routes[appID], nil
+}
+
+func (c *fakePreviewClient) CreateRoute(appID string, route *router.Route) error {
+	if c.failRoute {
+		return errors.New("route conflict")
+	}
+	c.routes[appID] = append(c.routes[appID], route)
+	return nil
+}
+
+// TestGithubPullRequestEvents tests that GitHub pull request events are
+// converted to events for the base branch
+func TestGithubPullRequestEvents(t *testing.T) {
+	body := []byte(`{
+  "action": "synchronize",
+  "number": 12,
+  "pull_request": {
+    "head": {"ref": "feature/foo", "sha": "a1b2c3", "repo": {"full_name": "lmars/foo"}},
+    "base": {"ref": "master", "repo": {"full_name": "lmars/foo"}}
+  },
+  "repository": {"full_name": "lmars/foo", "clone_url": "https://github.com/lmars/foo.git"}
+}`)
+	events, err := githubProvider{}.Events("pull_request", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(events))
+	}
+	event := events[0]
+	if event.Ref != "refs/heads/master" || event.HeadCommit.ID != "a1b2c3" || event.Repository.CloneURL != "https://github.com/lmars/foo.git" {
+		t.Fatalf("unexpected event: %+v", event)
+	}
+	pr := event.PullRequest
+	if pr == nil || pr.Number != 12 || pr.Action != PullRequestUpdated || pr.Branch != "feature/foo" || pr.Fork {
+		t.Fatalf("unexpected pull request: %+v", pr)
+	}
+
+	body = []byte(`{"action":"opened","number":13,"pull_request":{"head":{"ref":"master","sha":"d4","repo":{"full_name":"someone/foo"}},"base":{"ref":"master"}},"repository":{"full_name":"lmars/foo"}}`)
+	events, err = githubProvider{}.Events("pull_request", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !events[0].PullRequest.Fork {
+		t.Fatal("expected pull request from another repo to be a fork")
+	}
+}
+
+// TestCreatePreviewApp tests that preview apps are created with a copy of
+// the template app's env, new resources and a route
+func TestCreatePreviewApp(t *testing.T) {
+	client := newFakePreviewClient()
+	template := &ct.App{Name: "foo-staging"}
+	client.CreateApp(template)
+	release := &ct.Release{Env: map[string]string{"RACK_ENV": "staging", "DATABASE_URL": "postgres://foo-staging"}}
+	client.CreateRelease(release)
+	client.SetAppRelease(template.ID, release.ID)
+	client.resources[template.ID] = []*ct.Resource{{ProviderID: "postgres", Apps: []string{template.ID}}}
+	client.routes[template.ID] = []*router.Route{router.HTTPRoute{Domain: "foo-staging.example.com", Service: "foo-staging-web"}.ToRoute()}
+
+	s := newTestServer(nil, client, nil)
+	domain, err := s.createPreviewApp("foo-staging-pr-12", "foo-staging")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if domain != "foo-staging-pr-12.example.com" {
+		t.Fatalf("unexpected domain: %q", domain)
+	}
+	app, err := client.GetApp("foo-staging-pr-12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if app.Meta["webhook-deploy-template"] != "foo-staging" {
+		t.Fatalf("unexpected app meta: %v", app.Meta)
+	}
+	env := client.releases[app.ReleaseID].Env
+	if env["RACK_ENV"] != "staging" || env["DATABASE_URL"] != "postgres://"+app.ID {
+		t.Fatalf("unexpected preview env: %v", env)
+	}
+	routes := client.routes[app.ID]
+	if len(routes) != 1 || routes[0].Domain != domain || routes[0].Service != "foo-staging-pr-12-web" {
+		t.Fatalf("unexpected preview routes: %v", routes)
+	}
+
+	// check PREVIEW_DOMAIN is used if set
+	s.previewDomainSuffix = "preview.example.com"
+	if domain, err := s.previewDomain(template, "foo-staging-pr-13"); err != nil || domain != "foo-staging-pr-13.preview.example.com" {
+		t.Fatalf("unexpected domain %q (error: %v)", domain, err)
+	}
+
+	// check the app is deleted if creating it fails
+	client.failRoute = true
+	if _, err := s.createPreviewApp("foo-staging-pr-14", "foo-staging"); err == nil {
+		t.Fatal("expected error creating preview app")
+	}
+	if len(client.deleted) != 1 || client.deleted[0] != "foo-staging-pr-14-id" {
+		t.Fatalf("expected failed preview app to be deleted, got %v", client.deleted)
+	}
+}
+
+// TestPreviewDeployAccessApp tests that access to deploys of preview apps is
+// checked against the template app of their repo rule
+func TestPreviewDeployAccessApp(t *testing.T) {
+	previewRepos := map[int32]Repo{
+		1: {ID: 1, Apps: []string{"foo-staging"}, PreviewTemplate: "foo"},
+	}
+	for _, test := range []struct {
+		deploy *Deploy
+		app    string
+	}{
+		{&Deploy{RepoID: 1, App: "foo-1-pr-12"}, "foo"},
+		{&Deploy{RepoID: 1, App: "foo-staging"}, "foo-staging"},
+		{&Deploy{RepoID: 1, App: "foo-2-pr-12"}, "foo-2-pr-12"},
+		{&Deploy{RepoID: 2, App: "foo-2-pr-12"}, "foo-2-pr-12"},
+	} {
+		if app := test.deploy.accessApp(previewRepos); app != test.app {
+			t.Fatalf("expected deploy of %s (repo %d) to be checked against %s, got %s", test.deploy.App, test.deploy.RepoID, test.app, app)
+		}
+	}
+}
+
+// TestWebhookPullRequestPreview tests that opening a pull request deploys it
+// to a preview app, even if another rule deploys the template app, and that
+// the preview app is deleted when the pull request is closed, even if its
+// rule has since been deleted
+func TestWebhookPullRequestPreview(t *testing.T) {
+	db, err := setupTestDB("flynn_webhook_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	client := newFakePreviewClient()
+	client.CreateApp(&ct.App{Name: "foo-staging"})
+
+	secretToken := []byte("secret")
+	s := httptest.NewServer(newTestServer(db, client, secretToken))
+	defer s.Close()
+
+	// an older rule for the same branch and app takes precedence when
+	// deploying pushes, but does not stop previews being deployed
+	if err := db.Exec("INSERT INTO repos (name, branch, apps) VALUES ('lmars/foo', 'master', '{foo-staging}')"); err != nil {
+		t.Fatal(err)
+	}
+	var repoID int32
+	if err := db.QueryRow("INSERT INTO repos (name, branch, apps, preview_template) VALUES ('lmars/foo', 'master', '{foo-staging}', 'foo-staging') RETURNING id").Scan(&repoID); err != nil {
+		t.Fatal(err)
+	}
+	previewApp := fmt.Sprintf("foo-staging-%d-pr-12", repoID)
+
+	sendPullRequest := func(action, sha string) {
+		payload := map[string]interface{}{
+			"action": action,
+			"number": 12,
+			"pull_request": map[string]interface{}{
+				"head": map[string]interface{}{"ref": "feature", "sha": sha, "repo": map[string]string{"full_name": "lmars/foo"}},
+				"base": map[string]interface{}{"ref": "master"},
+			},
+			"repository": map[string]string{"full_name": "lmars/foo", "clone_url": "https://github.com/lmars/foo.git"},
+		}
+		res, err := sendWebhook(s.URL, "pull_request", payload, secretToken)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("expected ok response, got %s", res.Status)
+		}
+	}
+
+	sendPullRequest("opened", "a1")
+	sendPullRequest("synchronize", "a2")
+
+	if _, err := client.GetApp(previewApp); err != nil {
+		t.Fatalf("expected preview app to be created, got error: %s", err)
+	}
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM previews").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatalf("expected 1 preview, got %d", count)
+	}
+	var apps, branches []string
+	if err := db.QueryRow("SELECT array_agg(app ORDER BY id), array_agg(branch ORDER BY id) FROM deploys").Scan(&apps, &branches); err != nil {
+		t.Fatal(err)
+	}
+	if len(apps) != 2 || apps[0] != previewApp || apps[1] != previewApp || branches[0] != "feature" {
+		t.Fatalf("expected 2 deploys of the feature branch to the preview app, got %v %v", apps, branches)
+	}
+
+	sendPullRequest("closed", "a2")
+	if len(client.deleted) != 1 || client.deleted[0] != previewApp {
+		t.Fatalf("expected preview app to be deleted, got %v", client.deleted)
+	}
+	if err := db.QueryRow("SELECT COUNT(*) FROM previews").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Fatalf("expected preview to be deleted, got %d", count)
+	}
+
+	// reopening the pull request deploys the recreated preview app even
+	// though the head has already been deployed
+	sendPullRequest("reopened", "a2")
+	if err := db.QueryRow("SELECT COUNT(*) FROM deploys WHERE app = $1 AND commit = 'a2'", previewApp).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Fatalf("expected the reopened pull request to be deployed again, got %d deploys", count)
+	}
+
+	// closing the pull request deletes the preview app of a rule which
+	// has been deleted
+	if err := db.Exec("DELETE FROM repos WHERE id = $1", repoID); err != nil {
+		t.Fatal(err)
+	}
+	sendPullRequest("closed", "a2")
+	if len(client.deleted) != 2 || client.deleted[1] != previewApp {
+		t.Fatalf("expected preview app to be deleted again, got %v", client.deleted)
+	}
+	if err := db.QueryRow("SELECT COUNT(*) FROM previews").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Fatalf("expected preview to be deleted, got %d", count)
+	}
+}
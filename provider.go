@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+)
+
+// Provider parses and authenticates webhooks sent by a git host, converting
+// them into push events.
+type Provider interface {
+	// Name returns the name of the provider, which is stored in the
+	// provider column of repos so that repos with the same name on
+	// different hosts do not collide.
+	Name() string
+
+	// EventType returns the type of event from the request headers, or
+	// an empty string if the request was not sent by this provider.
+	EventType(h http.Header) string
+
+	// DeliveryID returns the unique ID of the delivery from the request
+	// headers, if the provider sends one.
+	DeliveryID(h http.Header) string
+
+	// RepoName returns the name of the repo which sent the webhook, used
+	// to look up the repo's secrets before authenticating the request.
+	RepoName(body []byte) string
+
+	// Authenticate checks that the request was sent using one of the
+	// given secrets.
+	Authenticate(h http.Header, body []byte, secrets [][]byte) error
+
+	// Events returns the push events contained in the webhook, returning
+	// errPing for events which just check the webhook is configured.
+	Events(eventType string, body []byte) ([]*Event, error)
+}
+
+// errPing is returned by Provider.Events for ping events.
+var errPing = errors.New("ping event")
+
+// errInvalidJSON is returned by Provider.Events if the payload cannot be
+// decoded.
+var errInvalidJSON = errors.New("invalid JSON payload")
+
+// redactedHeaders are headers which contain secrets and so are not stored
+// with deliveries.
+var redactedHeaders = []string{"X-Gitlab-Token", "Authorization"}
+
+func (s *Server) providers() []Provider {
+	return []Provider{
+		// Gitea and Forgejo also send GitHub's headers for
+		// compatibility so are checked before GitHub
+		giteaProvider{},
+		githubProvider{allowSHA1: s.allowSHA1 && !s.requireSHA256},
+		gitlabProvider{},
+		bitbucketCloudProvider{},
+		bitbucketServerProvider{},
+
+		// the generic provider matches any request with a bearer
+		// token so is checked last
+		genericProvider{},
+	}
+}
+
+// findProvider returns the provider which sent the request along with the
+// type of event, or nil if the request was not sent by a known provider.
+func (s *Server) findProvider(h http.Header) (Provider, string) {
+	for _, p := range s.providers() {
+		if eventType := p.EventType(h); eventType != "" {
+			return p, eventType
+		}
+	}
+	return nil, ""
+}
+
+// provider returns the provider with the given name, or nil if there is
+// no such provider.
+func (s *Server) provider(name string) Provider {
+	for _, p := range s.providers() {
+		if p.Name() == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// isProvider returns whether name is the name of a known provider.
+func (s *Server) isProvider(name string) bool {
+	return s.provider(name) != nil
+}
+
+// validHMAC returns whether sig is the HMAC of the body using one of the
+// secrets, formatted as a hex string with the given prefix.
+func validHMAC(sig, prefix string, hash func() hash.Hash, body []byte, secrets [][]byte) bool {
+	for _, secret := range secrets {
+		mac := hmac.New(hash, secret)
+		mac.Write(body)
+		if hmac.Equal([]byte(fmt.Sprintf("%s%x", prefix, mac.Sum(nil))), []byte(sig)) {
+			return true
+		}
+	}
+	return false
+}
+
+// validToken returns whether the token matches one of the secrets.
+func validToken(token string, secrets [][]byte) bool {
+	if token == "" {
+		return false
+	}
+	for _, secret := range secrets {
+		if subtle.ConstantTimeCompare([]byte(token), secret) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// redactHeader returns a copy of h with any secret headers redacted.
+func redactHeader(h http.Header) http.Header {
+	redacted := make(http.Header, len(h))
+	for k, v := range h {
+		redacted[k] = v
+	}
+	for _, k := range redactedHeaders {
+		if redacted.Get(k) != "" {
+			redacted.Set(k, "[redacted]")
+		}
+	}
+	return redacted
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"path"
+	"regexp"
+	"strings"
+)
+
+const (
+	RefTypeBranch = "branch"
+	RefTypeTag    = "tag"
+)
+
+// Ref is a git ref which can trigger a deploy, either a branch or a tag.
+type Ref struct {
+	Type string
+	Name string
+}
+
+// parseRef parses a fully qualified git ref (e.g. "refs/heads/feature/foo"
+// or "refs/tags/v1.2.0"), returning false for refs which are neither
+// branches nor tags (e.g. "refs/pull/1/head").
+func parseRef(ref string) (Ref, bool) {
+	switch {
+	case strings.HasPrefix(ref, "refs/heads/") && len(ref) > len("refs/heads/"):
+		return Ref{Type: RefTypeBranch, Name: strings.TrimPrefix(ref, "refs/heads/")}, true
+	case strings.HasPrefix(ref, "refs/tags/") && len(ref) > len("refs/tags/"):
+		return Ref{Type: RefTypeTag, Name: strings.TrimPrefix(ref, "refs/tags/")}, true
+	default:
+		return Ref{}, false
+	}
+}
+
+func (r Ref) String() string {
+	return r.Type + " " + r.Name
+}
+
+// The kinds of branch and tag patterns used by repo rules, in order of
+// precedence when rules of different kinds match the same ref.
+const (
+	patternExact = iota
+	patternGlob
+	patternRegexp
+)
+
+// patternKind returns the kind of a branch or tag pattern, which is a
+// regular expression if wrapped in slashes (e.g. "/feature-.*/"), a glob if
+// it contains glob metacharacters (e.g. "release/*") and otherwise an exact
+// name.
+//
+// Neither form is ambiguous since git ref names cannot start with a slash
+// or contain "*", "?" or "[".
+func patternKind(pattern string) int {
+	switch {
+	case len(pattern) > 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/"):
+		return patternRegexp
+	case strings.ContainsAny(pattern, "*?["):
+		return patternGlob
+	default:
+		return patternExact
+	}
+}
+
+// compilePatternRegexp compiles a regular expression pattern, anchored so
+// that it must match the whole name.
+func compilePatternRegexp(pattern string) (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + pattern[1:len(pattern)-1] + ")$")
+}
+
+// validRefPattern returns whether the branch or tag pattern is valid.
+func validRefPattern(pattern string) bool {
+	switch patternKind(pattern) {
+	case patternRegexp:
+		_, err := compilePatternRegexp(pattern)
+		return err == nil
+	case patternGlob:
+		_, err := path.Match(pattern, "")
+		return err == nil
+	default:
+		return true
+	}
+}
+
+// matchRefPattern returns whether the branch or tag name matches the
+// pattern, treating invalid patterns as not matching.
+func matchRefPattern(pattern, name string) bool {
+	switch patternKind(pattern) {
+	case patternRegexp:
+		re, err := compilePatternRegexp(pattern)
+		return err == nil && re.MatchString(name)
+	case patternGlob:
+		matched, _ := path.Match(pattern, name)
+		return matched
+	default:
+		return pattern == name
+	}
+}
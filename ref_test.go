@@ -0,0 +1,62 @@
+package main
+
+import "testing"
+
+// TestParseRef tests that git refs are parsed into branches and tags
+func TestParseRef(t *testing.T) {
+	for _, test := range []struct {
+		ref      string
+		expected Ref
+		ok       bool
+	}{
+		{"refs/heads/master", Ref{Type: RefTypeBranch, Name: "master"}, true},
+		{"refs/heads/feature/foo", Ref{Type: RefTypeBranch, Name: "feature/foo"}, true},
+		{"refs/tags/v1.2.0", Ref{Type: RefTypeTag, Name: "v1.2.0"}, true},
+		{"refs/tags/release/1.2", Ref{Type: RefTypeTag, Name: "release/1.2"}, true},
+		{"refs/pull/1/head", Ref{}, false},
+		{"refs/heads/", Ref{}, false},
+		{"master", Ref{}, false},
+	} {
+		ref, ok := parseRef(test.ref)
+		if ok != test.ok || ref != test.expected {
+			t.Fatalf("expected %q to parse as %+v (ok=%t), got %+v (ok=%t)", test.ref, test.expected, test.ok, ref, ok)
+		}
+	}
+}
+
+// TestMatchRefPattern tests that branch and tag patterns match exact names,
+// globs and regular expressions
+func TestMatchRefPattern(t *testing.T) {
+	for _, test := range []struct {
+		pattern string
+		name    string
+		matched bool
+	}{
+		{"master", "master", true},
+		{"master", "master2", false},
+		{"release/*", "release/1.0", true},
+		{"release/*", "release/1.0/hotfix", false},
+		{"release/*", "releases/1.0", false},
+		{"v*", "v1.2.0", true},
+		{"/feature-.*/", "feature-foo", true},
+		{"/feature-.*/", "my-feature-foo", false},
+		{"/v[0-9]+\\.[0-9]+/", "v1.2", true},
+		{"/v[0-9]+\\.[0-9]+/", "v1.2.3", false},
+		{"/(/", "(", false},
+	} {
+		if matched := matchRefPattern(test.pattern, test.name); matched != test.matched {
+			t.Fatalf("expected %q matching %q to be %t, got %t", test.pattern, test.name, test.matched, matched)
+		}
+	}
+
+	for _, pattern := range []string{"master", "release/*", "/feature-.*/"} {
+		if !validRefPattern(pattern) {
+			t.Fatalf("expected %q to be valid", pattern)
+		}
+	}
+	for _, pattern := range []string{"release/[", "/(/"} {
+		if validRefPattern(pattern) {
+			t.Fatalf("expected %q to be invalid", pattern)
+		}
+	}
+}
@@ -0,0 +1,613 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn/controller/client"
+	"github.com/flynn/flynn/pkg/postgres"
+	"github.com/jackc/pgx"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Repo is a rule which deploys pushes to a repo to one or more apps, either of
+// branches matching Branch or, if TagPattern is set, of tags matching the
+// pattern (in which case branch pushes are ignored).
+//
+// Both Branch and TagPattern may be an exact name, a glob or a regular
+// expression wrapped in slashes (see patternKind).
+//
+// IncludePaths and ExcludePaths restrict the rule to pushes which change
+// matching files (see MatchPaths). BuildContext must be empty since taffy
+// always builds the root of the repo (see errBuildContextUnsupported).
+//
+// If PreviewTemplate is set, pull requests against matching branches are
+// deployed to preview apps created from the template app.
+//
+// AppIDs holds the IDs of the apps so that renamed apps are still deployed,
+// and is empty for repos added before app IDs were stored, which are
+// deployed by name. Repos whose AppIDs do not match Apps (e.g. because the
+// apps were changed with psql) are also deployed by name (see hasAppIDs).
+type Repo struct {
+	ID              int32      `json:"id"`
+	Provider        string     `json:"provider"`
+	Name            string     `json:"name"`
+	Branch          string     `json:"branch"`
+	TagPattern      string     `json:"tag_pattern,omitempty"`
+	Apps            []string   `json:"apps"`
+	AppIDs          []string   `json:"app_ids"`
+	OrphanedApps    []string   `json:"orphaned_apps,omitempty"`
+	IncludePaths    []string   `json:"include_paths,omitempty"`
+	ExcludePaths    []string   `json:"exclude_paths,omitempty"`
+	BuildContext    string     `json:"build_context,omitempty"`
+	PreviewTemplate string     `json:"preview_template,omitempty"`
+	HasSecret       bool       `json:"has_secret"`
+	CreatedAt       *time.Time `json:"created_at"`
+}
+
+const repoColumns = "id, provider, name, branch, tag_pattern, apps, app_ids, include_paths, exclude_paths, build_context, preview_template, secret IS NOT NULL, created_at"
+
+func scanRepo(s postgres.Scanner) (Repo, error) {
+	var r Repo
+	return r, s.Scan(&r.ID, &r.Provider, &r.Name, &r.Branch, &r.TagPattern, &r.Apps, &r.AppIDs, &r.IncludePaths, &r.ExcludePaths, &r.BuildContext, &r.PreviewTemplate, &r.HasSecret, &r.CreatedAt)
+}
+
+func (s *Server) getRepos(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	rows, err := s.db.Query("SELECT " + repoColumns + " FROM repos")
+	if err != nil {
+		log.Println("error getting repos from db:", err)
+		http.Error(w, "error getting repos", 500)
+		return
+	}
+	var repos []Repo
+	for rows.Next() {
+		repo, err := scanRepo(rows)
+		if err != nil {
+			rows.Close()
+			log.Println("error scanning db row:", err)
+			http.Error(w, "error getting repos", 500)
+			return
+		}
+		repos = append(repos, repo)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("error scanning db rows:", err)
+		http.Error(w, "error getting repos", 500)
+		return
+	}
+	if names, err := s.appNames(); err != nil {
+		log.Println("error getting apps:", err)
+	} else {
+		for i := range repos {
+			repos[i].refreshApps(names)
+		}
+	}
+	caller := requestCaller(req)
+	visible := repos[:0]
+	for _, repo := range repos {
+		if caller.CanAccessApps(ScopeReposRead, repo.Apps...) {
+			visible = append(visible, repo)
+		}
+	}
+	repos = visible
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(repos)
+}
+
+// repoRequest is the JSON body used to create or update a repo, which may
+// include the webhook secret when creating it.
+type repoRequest struct {
+	Repo
+	Secret string `json:"secret,omitempty"`
+}
+
+// createRepo creates a repo from either a form submitted by the UI, which
+// redirects back to the UI, or a JSON body, which responds with the repo.
+func (s *Server) createRepo(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	isJSON := strings.HasPrefix(req.Header.Get("Content-Type"), "application/json")
+	var r repoRequest
+	if isJSON {
+		if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+			http.Error(w, "invalid JSON body", 400)
+			return
+		}
+	} else {
+		req.ParseForm()
+		r.Repo = Repo{
+			Provider:        req.FormValue("provider"),
+			Name:            req.FormValue("name"),
+			Branch:          req.FormValue("branch"),
+			TagPattern:      req.FormValue("tag_pattern"),
+			Apps:            req.Form["app"],
+			IncludePaths:    formList(req, "include_paths"),
+			ExcludePaths:    formList(req, "exclude_paths"),
+			BuildContext:    req.FormValue("build_context"),
+			PreviewTemplate: req.FormValue("preview_template"),
+		}
+		r.Secret = req.FormValue("secret")
+	}
+	if err := s.validateRepo(&r.Repo); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if !s.resolveApps(w, &r.Repo) || !checkApps(w, req, ScopeReposWrite, r.managedApps()...) {
+		return
+	}
+	var secret []byte
+	if r.Secret != "" {
+		if s.secretBox == nil {
+			http.Error(w, "per-repo secrets require REPO_SECRET_KEY to be set", 400)
+			return
+		}
+		var err error
+		secret, err = s.secretBox.Seal([]byte(r.Secret))
+		if err != nil {
+			log.Println("error encrypting repo secret:", err)
+			http.Error(w, "error adding repo", 500)
+			return
+		}
+		r.HasSecret = true
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		log.Println("error starting db transaction:", err)
+		http.Error(w, "error adding repo", 500)
+		return
+	}
+	defer tx.Rollback()
+	err = tx.QueryRow("INSERT INTO repos (provider, name, branch, tag_pattern, apps, app_ids, include_paths, exclude_paths, build_context, preview_template, secret) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) RETURNING id, created_at",
+		r.Provider, r.Name, r.Branch, r.TagPattern, r.Apps, r.AppIDs, r.IncludePaths, r.ExcludePaths, r.BuildContext, r.PreviewTemplate, secret,
+	).Scan(&r.ID, &r.CreatedAt)
+	if postgres.IsUniquenessError(err, "repos_rule_key") {
+		http.Error(w, "a repo with the same settings already exists", 409)
+		return
+	} else if err != nil {
+		log.Println("error adding repo to db:", err)
+		http.Error(w, "error adding repo", 500)
+		return
+	}
+	if !s.commitAudited(w, req, tx, repoAuditEvent(AuditRepoCreate, &r.Repo), "error adding repo") {
+		return
+	}
+	if !isJSON {
+		http.Redirect(w, req, "/", 302)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(r.Repo)
+}
+
+// validateRepo validates the repo settings, setting defaults and removing
+// empty or duplicate apps.
+func (s *Server) validateRepo(r *Repo) error {
+	apps := []string{}
+	seen := make(map[string]bool)
+	for _, app := range r.Apps {
+		if app != "" && !seen[app] {
+			seen[app] = true
+			apps = append(apps, app)
+		}
+	}
+	r.Apps = apps
+	if r.Name == "" || len(r.Apps) == 0 {
+		return errors.New("both name and app are required")
+	}
+	if r.Provider == "" {
+		r.Provider = "github"
+	} else if !s.isProvider(r.Provider) {
+		return errors.New("unknown provider: " + r.Provider)
+	}
+	if r.TagPattern != "" {
+		if !validRefPattern(r.TagPattern) {
+			return errors.New("invalid tag_pattern: " + r.TagPattern)
+		}
+		// tag rules do not deploy branches
+		r.Branch = ""
+	} else if r.Branch == "" {
+		r.Branch = "master"
+	} else if !validRefPattern(r.Branch) {
+		return errors.New("invalid branch: " + r.Branch)
+	}
+	if r.IncludePaths == nil {
+		r.IncludePaths = []string{}
+	}
+	if r.ExcludePaths == nil {
+		r.ExcludePaths = []string{}
+	}
+	for _, globs := range [][]string{r.IncludePaths, r.ExcludePaths} {
+		for _, glob := range globs {
+			if !validPathGlob(glob) {
+				return errors.New("invalid path: " + glob)
+			}
+		}
+	}
+	if r.BuildContext != "" {
+		return errBuildContextUnsupported
+	}
+	return nil
+}
+
+// errBuildContextUnsupported is returned for repos with a build context,
+// since taffy always builds the root of the repo and would otherwise deploy
+// the wrong thing. Repos containing several apps can instead use
+// include_paths to only deploy the apps whose files changed.
+var errBuildContextUnsupported = errors.New("build_context is not supported since taffy always builds the root of the repo")
+
+// appNotFoundError is returned by lookupApps if an app does not exist.
+type appNotFoundError string
+
+func (e appNotFoundError) Error() string {
+	return "app not found: " + string(e)
+}
+
+// lookupApps checks that the apps of the repo and its preview template
+// exist, which may be given by either name or ID, and sets AppIDs along with
+// the current app names.
+func (s *Server) lookupApps(r *Repo) error {
+	apps := make([]string, 0, len(r.Apps))
+	ids := make([]string, 0, len(r.Apps))
+	seen := make(map[string]bool, len(r.Apps))
+	for _, name := range r.Apps {
+		app, err := s.client.GetApp(name)
+		if err == controller.ErrNotFound {
+			return appNotFoundError(name)
+		} else if err != nil {
+			return fmt.Errorf("error getting app %q: %s", name, err)
+		}
+		if seen[app.ID] {
+			continue
+		}
+		seen[app.ID] = true
+		apps = append(apps, app.Name)
+		ids = append(ids, app.ID)
+	}
+	r.Apps = apps
+	r.AppIDs = ids
+	if r.PreviewTemplate != "" {
+		app, err := s.client.GetApp(r.PreviewTemplate)
+		if err == controller.ErrNotFound {
+			return appNotFoundError(r.PreviewTemplate)
+		} else if err != nil {
+			return fmt.Errorf("error getting app %q: %s", r.PreviewTemplate, err)
+		}
+		r.PreviewTemplate = app.Name
+	}
+	return nil
+}
+
+// clone returns a copy of the repo which does not share its slices, so that
+// changing the copy does not change r.
+func (r *Repo) clone() Repo {
+	c := *r
+	for _, s := range []*[]string{&c.Apps, &c.AppIDs, &c.OrphanedApps, &c.IncludePaths, &c.ExcludePaths} {
+		if *s != nil {
+			*s = append([]string{}, *s...)
+		}
+	}
+	return c
+}
+
+// managedApps returns the apps which changing the repo affects, which are
+// its apps and the preview template, whose env is copied to preview apps.
+func (r *Repo) managedApps() []string {
+	if r.PreviewTemplate == "" {
+		return r.Apps
+	}
+	return appendMissing(r.Apps, r.PreviewTemplate)
+}
+
+// resolveApps looks up the apps of the repo using lookupApps, writing an
+// error response and returning false if they cannot be looked up.
+func (s *Server) resolveApps(w http.ResponseWriter, r *Repo) bool {
+	err := s.lookupApps(r)
+	if e, ok := err.(appNotFoundError); ok {
+		http.Error(w, e.Error(), 400)
+		return false
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, "error getting apps", 500)
+		return false
+	}
+	return true
+}
+
+// appNames returns the names of the existing apps keyed by app ID.
+func (s *Server) appNames() (map[string]string, error) {
+	apps, err := s.client.AppList()
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]string, len(apps))
+	for _, app := range apps {
+		names[app.ID] = app.Name
+	}
+	return names, nil
+}
+
+// hasAppIDs returns whether AppIDs holds the ID of each app.
+func (r *Repo) hasAppIDs() bool {
+	return len(r.AppIDs) > 0 && len(r.AppIDs) == len(r.Apps)
+}
+
+// refreshApps sets the app names of the repo to the current names of the
+// apps in case they have been renamed, and sets OrphanedApps to the apps
+// which have since been deleted. Repos without AppIDs are matched by name.
+func (r *Repo) refreshApps(names map[string]string) {
+	r.OrphanedApps = nil
+	if !r.hasAppIDs() {
+		exists := make(map[string]bool, len(names))
+		for _, name := range names {
+			exists[name] = true
+		}
+		for _, app := range r.Apps {
+			if !exists[app] {
+				r.OrphanedApps = append(r.OrphanedApps, app)
+			}
+		}
+		return
+	}
+	for i, id := range r.AppIDs {
+		if name, ok := names[id]; ok {
+			r.Apps[i] = name
+		} else {
+			r.OrphanedApps = append(r.OrphanedApps, r.Apps[i])
+		}
+	}
+}
+
+// loadRepo loads the repo with the ID in the request params, writing an
+// error response and returning nil if it cannot be loaded.
+func (s *Server) loadRepo(w http.ResponseWriter, params httprouter.Params) *Repo {
+	id, err := strconv.ParseInt(params.ByName("id"), 10, 32)
+	if err != nil {
+		http.Error(w, "invalid repo id", 400)
+		return nil
+	}
+	repo, err := scanRepo(s.db.QueryRow("SELECT "+repoColumns+" FROM repos WHERE id = $1", int32(id)))
+	if err == pgx.ErrNoRows {
+		http.Error(w, "repo not found", 404)
+		return nil
+	} else if err != nil {
+		log.Println("error getting repo from db:", err)
+		http.Error(w, "error getting repo", 500)
+		return nil
+	}
+	return &repo
+}
+
+func (s *Server) getRepo(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	repo := s.loadRepo(w, params)
+	if repo == nil || !checkApps(w, req, ScopeReposRead, repo.Apps...) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(repo)
+}
+
+// updateRepo replaces the settings of a repo with the JSON body for PUT
+// requests, or updates just the fields in the body for PATCH requests.
+//
+// The secret cannot be changed, use PUT /repos/:id/secret instead.
+func (s *Server) updateRepo(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	existing := s.loadRepo(w, params)
+	if existing == nil || !checkApps(w, req, ScopeReposWrite, existing.managedApps()...) {
+		return
+	}
+	// decode into a copy so that existing is unchanged for the audit log
+	repo := existing.clone()
+	if req.Method == "PUT" {
+		repo = Repo{}
+	} else if existing.hasAppIDs() {
+		// look up the existing apps by ID in case they have been renamed
+		repo.Apps = append([]string{}, existing.AppIDs...)
+	}
+	if err := json.NewDecoder(req.Body).Decode(&repo); err != nil {
+		http.Error(w, "invalid JSON body", 400)
+		return
+	}
+	repo.ID = existing.ID
+	repo.HasSecret = existing.HasSecret
+	repo.CreatedAt = existing.CreatedAt
+	if err := s.validateRepo(&repo); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if !s.resolveApps(w, &repo) || !checkApps(w, req, ScopeReposWrite, repo.managedApps()...) {
+		return
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		log.Println("error starting db transaction:", err)
+		http.Error(w, "error updating repo", 500)
+		return
+	}
+	defer tx.Rollback()
+	// the repo may have been deleted since it was loaded
+	err = tx.QueryRow("UPDATE repos SET provider = $1, name = $2, branch = $3, tag_pattern = $4, apps = $5, app_ids = $6, include_paths = $7, exclude_paths = $8, build_context = $9, preview_template = $10 WHERE id = $11 RETURNING id",
+		repo.Provider, repo.Name, repo.Branch, repo.TagPattern, repo.Apps, repo.AppIDs, repo.IncludePaths, repo.ExcludePaths, repo.BuildContext, repo.PreviewTemplate, repo.ID,
+	).Scan(&repo.ID)
+	if err == pgx.ErrNoRows {
+		http.Error(w, "repo not found", 404)
+		return
+	} else if postgres.IsUniquenessError(err, "repos_rule_key") {
+		http.Error(w, "a repo with the same settings already exists", 409)
+		return
+	} else if err != nil {
+		log.Println("error updating repo:", err)
+		http.Error(w, "error updating repo", 500)
+		return
+	}
+	if !s.commitAudited(w, req, tx, &AuditEvent{
+		Action:  AuditRepoUpdate,
+		Apps:    appendMissing(existing.Apps, repo.Apps...),
+		RepoID:  &repo.ID,
+		Details: map[string]interface{}{"before": existing, "after": repo},
+	}, "error updating repo") {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(repo)
+}
+
+// deleteRepo deletes a repo, keeping the history of its deploys.
+func (s *Server) deleteRepo(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	repo := s.loadRepo(w, params)
+	if repo == nil || !checkApps(w, req, ScopeReposWrite, repo.managedApps()...) {
+		return
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		log.Println("error starting db transaction:", err)
+		http.Error(w, "error deleting repo", 500)
+		return
+	}
+	defer tx.Rollback()
+	if err := tx.Exec("DELETE FROM repos WHERE id = $1", repo.ID); err != nil {
+		log.Println("error deleting repo:", err)
+		http.Error(w, "error deleting repo", 500)
+		return
+	}
+	if !s.commitAudited(w, req, tx, repoAuditEvent(AuditRepoDelete, repo), "error deleting repo") {
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// appendMissing appends the items which are not already in list.
+func appendMissing(list []string, items ...string) []string {
+	list = append([]string{}, list...)
+	for _, item := range items {
+		found := false
+		for _, existing := range list {
+			if existing == item {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// formList returns the non-empty lines of the values of the form field,
+// which may either be repeated or contain one value per line.
+func formList(req *http.Request, key string) []string {
+	req.ParseForm()
+	list := []string{}
+	for _, v := range req.Form[key] {
+		for _, line := range strings.Split(v, "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				list = append(list, line)
+			}
+		}
+	}
+	return list
+}
+
+// matchRepos returns the repo rules which deploy the given ref, ordered by
+// precedence: exact names first, then globs, then regular expressions, with
+// older rules first within each kind.
+//
+// If several matching rules deploy to the same app, the app is only
+// included in the Apps of the rule with the highest precedence so that it
+// is not deployed twice (e.g. a "release/1.x" rule overrides a "release/*"
+// rule for the same app), and rules left without any apps are omitted.
+func (s *Server) matchRepos(provider, name string, ref Ref, files []string) ([]Repo, error) {
+	matched, err := s.matchingRepos(provider, name, ref, files)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		return patternKind(matched[i].Pattern(ref.Type)) < patternKind(matched[j].Pattern(ref.Type))
+	})
+	if err := s.refreshMatchedApps(matched); err != nil {
+		log.Println("error getting apps, deploying by stored app name:", err)
+	}
+	repos := make([]Repo, 0, len(matched))
+	apps := make(map[string]struct{}, len(matched))
+	for _, repo := range matched {
+		orphaned := make(map[string]bool, len(repo.OrphanedApps))
+		for _, app := range repo.OrphanedApps {
+			orphaned[app] = true
+		}
+		var repoApps []string
+		for _, app := range repo.Apps {
+			if orphaned[app] {
+				log.Printf("skipping deleted app %s of repo %d\n", app, repo.ID)
+				continue
+			}
+			if _, ok := apps[app]; ok {
+				continue
+			}
+			apps[app] = struct{}{}
+			repoApps = append(repoApps, app)
+		}
+		if len(repoApps) > 0 {
+			repo.Apps = repoApps
+			repos = append(repos, repo)
+		}
+	}
+	return repos, nil
+}
+
+// matchingRepos returns every repo rule which deploys the given ref and
+// files, in the order they were added.
+func (s *Server) matchingRepos(provider, name string, ref Ref, files []string) ([]Repo, error) {
+	rows, err := s.db.Query("SELECT "+repoColumns+" FROM repos WHERE provider = $1 AND name = $2 ORDER BY id", provider, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var matched []Repo
+	for rows.Next() {
+		repo, err := scanRepo(rows)
+		if err != nil {
+			return nil, err
+		}
+		if repo.Pattern(ref.Type) != "" && matchRefPattern(repo.Pattern(ref.Type), ref.Name) && repo.MatchPaths(files) {
+			matched = append(matched, repo)
+		}
+	}
+	return matched, rows.Err()
+}
+
+// refreshMatchedApps refreshes the apps of matched repos which have AppIDs,
+// leaving repos without them to be deployed by name as before.
+func (s *Server) refreshMatchedApps(repos []Repo) error {
+	var names map[string]string
+	for i := range repos {
+		if !repos[i].hasAppIDs() {
+			continue
+		}
+		if names == nil {
+			var err error
+			if names, err = s.appNames(); err != nil {
+				return err
+			}
+		}
+		repos[i].refreshApps(names)
+	}
+	return nil
+}
+
+// Pattern returns the pattern the rule uses to match refs of the given
+// type, which is empty if the rule does not deploy refs of that type.
+func (r Repo) Pattern(refType string) string {
+	if refType == RefTypeTag {
+		return r.TagPattern
+	}
+	if r.TagPattern != "" {
+		return ""
+	}
+	return r.Branch
+}
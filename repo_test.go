@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/flynn/flynn/controller/client"
+	ct "github.com/flynn/flynn/controller/types"
+)
+
+// fakeAppClient implements the controller client methods used to look up
+// the apps of repos
+type fakeAppClient struct {
+	controller.Client
+
+	apps []*ct.App
+}
+
+// newFakeAppClient returns a fakeAppClient with the given apps, each of
+// which has an ID of the name with an "-id" suffix
+func newFakeAppClient(names ...string) *fakeAppClient {
+	c := &fakeAppClient{}
+	for _, name := range names {
+		c.apps = append(c.apps, &ct.App{ID: name + "-id", Name: name})
+	}
+	return c
+}
+
+func (c *fakeAppClient) GetApp(id string) (*ct.App, error) {
+	for _, app := range c.apps {
+		if app.ID == id || app.Name == id {
+			return app, nil
+		}
+	}
+	return nil, controller.ErrNotFound
+}
+
+func (c *fakeAppClient) AppList() ([]*ct.App, error) {
+	return c.apps, nil
+}
+
+// sendJSON sends a request with the given JSON body, decoding the response
+// body into out if it is not nil
+func sendJSON(method, url, body string, out interface{}) (*http.Response, error) {
+	return sendAuthJSON(method, url, "", body, out)
+}
+
+// sendAuthJSON is like sendJSON but also sets the Authorization header
+func sendAuthJSON(method, url, auth, body string, out interface{}) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader([]byte(body)))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if out != nil && res.StatusCode < 300 {
+		if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// TestRepoCRUD tests that repos can be read, updated and deleted via the
+// JSON API
+func TestRepoCRUD(t *testing.T) {
+	db, err := setupTestDB("flynn_webhook_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	s := httptest.NewServer(newTestServer(db, newFakeAppClient("foo", "bar", "baz", "foo-production"), nil))
+	defer s.Close()
+
+	var repo Repo
+	res, err := sendJSON("POST", s.URL+"/repos", `{"name":"lmars/foo","apps":["foo","foo","bar"]}`, &repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201 response, got %s", res.Status)
+	}
+	if repo.ID == 0 || repo.Provider != "github" || repo.Branch != "master" {
+		t.Fatalf("unexpected repo: %+v", repo)
+	}
+	if fmt.Sprint(repo.Apps) != "[foo bar]" {
+		t.Fatalf("expected apps [foo bar], got %v", repo.Apps)
+	}
+	url := fmt.Sprintf("%s/repos/%d", s.URL, repo.ID)
+
+	// creating a repo with the same settings is a conflict
+	res, err = sendJSON("POST", s.URL+"/repos", `{"name":"lmars/foo","branch":"master","apps":["baz"]}`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusConflict {
+		t.Fatalf("expected 409 response, got %s", res.Status)
+	}
+
+	var got Repo
+	res, err = sendJSON("GET", url, "", &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected ok response, got %s", res.Status)
+	}
+	if got.Name != "lmars/foo" || fmt.Sprint(got.Apps) != "[foo bar]" {
+		t.Fatalf("unexpected repo: %+v", got)
+	}
+
+	// PATCH only changes the given fields
+	res, err = sendJSON("PATCH", url, `{"branch":"develop","include_paths":["web"]}`, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected ok response, got %s", res.Status)
+	}
+	if got.ID != repo.ID || got.Branch != "develop" || fmt.Sprint(got.IncludePaths) != "[web]" || fmt.Sprint(got.Apps) != "[foo bar]" {
+		t.Fatalf("unexpected repo: %+v", got)
+	}
+
+	// PUT replaces all the settings
+	res, err = sendJSON("PUT", url, `{"name":"lmars/foo","tag_pattern":"v*","apps":["foo-production"]}`, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected ok response, got %s", res.Status)
+	}
+	if got.Branch != "" || got.TagPattern != "v*" || len(got.IncludePaths) != 0 || fmt.Sprint(got.Apps) != "[foo-production]" {
+		t.Fatalf("unexpected repo: %+v", got)
+	}
+
+	// an update which conflicts with another repo is rejected
+	res, err = sendJSON("POST", s.URL+"/repos", `{"name":"lmars/foo","apps":["foo"]}`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201 response, got %s", res.Status)
+	}
+	res, err = sendJSON("PUT", url, `{"name":"lmars/foo","apps":["foo"]}`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusConflict {
+		t.Fatalf("expected 409 response, got %s", res.Status)
+	}
+
+	for _, body := range []string{`{`, `{"name":"lmars/foo","apps":[]}`, `{"name":"lmars/foo","apps":["foo"],"build_context":"web"}`} {
+		res, err = sendJSON("PUT", url, body, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected 400 response for %s, got %s", body, res.Status)
+		}
+	}
+
+	res, err = sendJSON("DELETE", url, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204 response, got %s", res.Status)
+	}
+	for _, method := range []string{"GET", "PUT", "PATCH", "DELETE"} {
+		res, err = sendJSON(method, url, `{}`, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusNotFound {
+			t.Fatalf("expected 404 response for %s, got %s", method, res.Status)
+		}
+	}
+}
+
+// TestRefreshAppsMismatchedIDs tests that repos whose app IDs do not match
+// their apps (e.g. because the apps were changed with psql) fall back to
+// matching the apps by name
+func TestRefreshAppsMismatchedIDs(t *testing.T) {
+	names := map[string]string{"foo-id": "foo-renamed", "bar-id": "bar"}
+	for _, repo := range []*Repo{
+		{Apps: []string{"foo", "bar"}, AppIDs: []string{"foo-id"}},
+		{Apps: []string{"foo", "bar"}, AppIDs: []string{"foo-id", "bar-id", "baz-id"}},
+	} {
+		repo.refreshApps(names)
+		if fmt.Sprint(repo.Apps) != "[foo bar]" || fmt.Sprint(repo.OrphanedApps) != "[foo]" {
+			t.Fatalf("unexpected apps %v with orphaned apps %v", repo.Apps, repo.OrphanedApps)
+		}
+	}
+}
+
+// TestRepoApps tests that the apps of repos must exist, and that repos keep
+// deploying to renamed apps and report deleted apps as orphaned
+func TestRepoApps(t *testing.T) {
+	db, err := setupTestDB("flynn_webhook_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	client := newFakeAppClient("foo", "bar")
+	secretToken := []byte("secret")
+	s := httptest.NewServer(newTestServer(db, client, secretToken))
+	defer s.Close()
+
+	res, err := sendJSON("POST", s.URL+"/repos", `{"name":"lmars/foo","apps":["foo","missing"]}`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 response, got %s", res.Status)
+	}
+
+	// apps can be given by name or ID
+	var repo Repo
+	res, err = sendJSON("POST", s.URL+"/repos", `{"name":"lmars/foo","apps":["foo","bar-id"]}`, &repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201 response, got %s", res.Status)
+	}
+	if fmt.Sprint(repo.Apps) != "[foo bar]" || fmt.Sprint(repo.AppIDs) != "[foo-id bar-id]" {
+		t.Fatalf("unexpected apps %v with IDs %v", repo.Apps, repo.AppIDs)
+	}
+
+	// rename foo and delete bar
+	client.apps[0].Name = "foo-renamed"
+	client.apps = client.apps[:1]
+
+	var repos []Repo
+	if _, err := sendJSON("GET", s.URL+"/repos.json", "", &repos); err != nil {
+		t.Fatal(err)
+	}
+	if len(repos) != 1 {
+		t.Fatalf("expected 1 repo, got %d", len(repos))
+	}
+	if fmt.Sprint(repos[0].Apps) != "[foo-renamed bar]" || fmt.Sprint(repos[0].OrphanedApps) != "[bar]" {
+		t.Fatalf("unexpected apps %v with orphaned apps %v", repos[0].Apps, repos[0].OrphanedApps)
+	}
+
+	event := Event{
+		Ref:        "refs/heads/master",
+		HeadCommit: Commit{ID: "a1b2c3"},
+		Repository: Repository{FullName: "lmars/foo", CloneURL: "https://github.com/lmars/foo.git"},
+	}
+	res, err = sendWebhook(s.URL, "push", event, secretToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected ok response, got %s", res.Status)
+	}
+	var apps []string
+	if err := db.QueryRow("SELECT array_agg(app) FROM deploys").Scan(&apps); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(apps) != "[foo-renamed]" {
+		t.Fatalf("expected a deploy of foo-renamed, got %v", apps)
+	}
+
+	// the orphaned app must be removed when updating the repo
+	url := fmt.Sprintf("%s/repos/%d", s.URL, repo.ID)
+	res, err = sendJSON("PATCH", url, `{"branch":"develop"}`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 response, got %s", res.Status)
+	}
+	res, err = sendJSON("PATCH", url, `{"apps":["foo-renamed"]}`, &repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected ok response, got %s", res.Status)
+	}
+	if fmt.Sprint(repo.Apps) != "[foo-renamed]" || fmt.Sprint(repo.AppIDs) != "[foo-id]" {
+		t.Fatalf("unexpected apps %v with IDs %v", repo.Apps, repo.AppIDs)
+	}
+}
@@ -0,0 +1,507 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/pkg/postgres"
+	"github.com/jackc/pgx"
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Roles which users and teams can be granted for apps, each of which can
+// do everything the previous one can.
+const (
+	RoleViewer   = "viewer"
+	RoleDeployer = "deployer"
+	RoleAdmin    = "admin"
+)
+
+var roleLevels = map[string]int{RoleViewer: 1, RoleDeployer: 2, RoleAdmin: 3}
+
+// scopeRoles is the role a user needs for an app to do what an API token
+// with the scope can do.
+var scopeRoles = map[string]string{
+	ScopeReposRead:      RoleViewer,
+	ScopeDeploysRead:    RoleViewer,
+	ScopeDeploysTrigger: RoleDeployer,
+	ScopeReposWrite:     RoleAdmin,
+}
+
+// roleAllows returns whether the role grants the scope.
+func roleAllows(role, scope string) bool {
+	required, ok := scopeRoles[scope]
+	return ok && roleLevels[role] >= roleLevels[required]
+}
+
+// Team is a group of users who are granted roles together.
+type Team struct {
+	ID        int32      `json:"id"`
+	Name      string     `json:"name"`
+	Members   []string   `json:"members"`
+	CreatedAt *time.Time `json:"created_at"`
+}
+
+const teamColumns = "teams.id, teams.name, coalesce((SELECT array_agg(users.username ORDER BY users.username) FROM team_members JOIN users ON users.id = team_members.user_id WHERE team_members.team_id = teams.id), '{}'), teams.created_at"
+
+func scanTeam(s postgres.Scanner) (*Team, error) {
+	t := &Team{}
+	return t, s.Scan(&t.ID, &t.Name, &t.Members, &t.CreatedAt)
+}
+
+// RoleBinding grants a role to either a user or a team for either an app
+// (by name) or all apps with a meta label (formatted as key=value).
+type RoleBinding struct {
+	ID        int32      `json:"id"`
+	User      string     `json:"user,omitempty"`
+	Team      string     `json:"team,omitempty"`
+	Role      string     `json:"role"`
+	App       string     `json:"app,omitempty"`
+	Label     string     `json:"label,omitempty"`
+	CreatedAt *time.Time `json:"created_at"`
+}
+
+const roleBindingColumns = "role_bindings.id, coalesce(users.username, ''), coalesce(teams.name, ''), role_bindings.role, role_bindings.app, role_bindings.label, role_bindings.created_at"
+
+const roleBindingJoins = "role_bindings LEFT JOIN users ON users.id = role_bindings.user_id LEFT JOIN teams ON teams.id = role_bindings.team_id"
+
+func scanRoleBinding(s postgres.Scanner) (*RoleBinding, error) {
+	b := &RoleBinding{}
+	return b, s.Scan(&b.ID, &b.User, &b.Team, &b.Role, &b.App, &b.Label, &b.CreatedAt)
+}
+
+// matchesApp returns whether the binding applies to the app.
+func (b *RoleBinding) matchesApp(app *ct.App) bool {
+	if b.App != "" {
+		return b.App == app.Name
+	}
+	key, value, _ := splitLabel(b.Label)
+	v, ok := app.Meta[key]
+	return ok && v == value
+}
+
+// splitLabel splits a key=value label, returning false if it has no "=".
+func splitLabel(label string) (key, value string, ok bool) {
+	i := strings.Index(label, "=")
+	if i < 0 {
+		return label, "", false
+	}
+	return label[:i], label[i+1:], true
+}
+
+// userCaller returns the caller for a user, loading the roles granted to
+// non-admin users either directly or via their teams.
+func (s *Server) userCaller(user *User) (*Caller, error) {
+	caller := &Caller{User: user}
+	if user.Admin {
+		return caller, nil
+	}
+	rows, err := s.db.Query(
+		"SELECT "+roleBindingColumns+" FROM "+roleBindingJoins+" WHERE role_bindings.user_id = $1 OR role_bindings.team_id IN (SELECT team_id FROM team_members WHERE user_id = $1)",
+		user.ID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	var bindings []*RoleBinding
+	for rows.Next() {
+		b, err := scanRoleBinding(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		bindings = append(bindings, b)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	caller.appRoles = make(map[string]string)
+	grant := func(app, role string) {
+		if roleLevels[role] > roleLevels[caller.appRoles[app]] {
+			caller.appRoles[app] = role
+		}
+	}
+	var labelled bool
+	for _, b := range bindings {
+		if b.App != "" {
+			grant(b.App, b.Role)
+		} else {
+			labelled = true
+		}
+	}
+	if !labelled {
+		return caller, nil
+	}
+	apps, err := s.client.AppList()
+	if err != nil {
+		return nil, err
+	}
+	for _, app := range apps {
+		for _, b := range bindings {
+			if b.Label != "" && b.matchesApp(app) {
+				grant(app.Name, b.Role)
+			}
+		}
+	}
+	return caller, nil
+}
+
+// adminOnly returns a handle which responds with 403 Forbidden unless the
+// caller is an admin.
+func adminOnly(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		if !requestCaller(req).IsAdmin() {
+			http.Error(w, "only admins can make this request", 403)
+			return
+		}
+		h(w, req, params)
+	}
+}
+
+func (s *Server) getUsers(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	rows, err := s.db.Query("SELECT " + userColumns + " FROM users ORDER BY users.id")
+	if err != nil {
+		log.Println("error getting users from db:", err)
+		http.Error(w, "error getting users", 500)
+		return
+	}
+	users := []*User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			rows.Close()
+			log.Println("error scanning db row:", err)
+			http.Error(w, "error getting users", 500)
+			return
+		}
+		users = append(users, user)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("error scanning db rows:", err)
+		http.Error(w, "error getting users", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(users)
+}
+
+// createUser creates a user from the JSON body, which includes their
+// password.
+func (s *Server) createUser(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var u User
+	if err := json.NewDecoder(req.Body).Decode(&u); err != nil {
+		http.Error(w, "invalid JSON body", 400)
+		return
+	}
+	if u.Username == "" || u.Password == "" {
+		http.Error(w, "username and password are required", 400)
+		return
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(u.Password), bcrypt.DefaultCost)
+	if err != nil {
+		log.Println("error hashing password:", err)
+		http.Error(w, "error creating user", 500)
+		return
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		log.Println("error starting db transaction:", err)
+		http.Error(w, "error creating user", 500)
+		return
+	}
+	defer tx.Rollback()
+	err = tx.QueryRow(
+		"INSERT INTO users (username, password_hash, admin) VALUES ($1, $2, $3) RETURNING id, created_at",
+		u.Username, hash, u.Admin,
+	).Scan(&u.ID, &u.CreatedAt)
+	if postgres.IsUniquenessError(err, "users_username_key") {
+		http.Error(w, "user already exists", 409)
+		return
+	} else if err != nil {
+		log.Println("error creating user:", err)
+		http.Error(w, "error creating user", 500)
+		return
+	}
+	u.Password = ""
+	if !s.commitAudited(w, req, tx, &AuditEvent{Action: AuditUserCreate, Details: map[string]interface{}{"user": u}}, "error creating user") {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(u)
+}
+
+// deleteUser deletes a user along with their sessions, team memberships
+// and roles.
+func (s *Server) deleteUser(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	s.deleteByID(w, req, params, "user", AuditUserDelete, "DELETE FROM users WHERE id = $1 RETURNING id")
+}
+
+func (s *Server) getTeams(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	rows, err := s.db.Query("SELECT " + teamColumns + " FROM teams ORDER BY teams.id")
+	if err != nil {
+		log.Println("error getting teams from db:", err)
+		http.Error(w, "error getting teams", 500)
+		return
+	}
+	teams := []*Team{}
+	for rows.Next() {
+		team, err := scanTeam(rows)
+		if err != nil {
+			rows.Close()
+			log.Println("error scanning db row:", err)
+			http.Error(w, "error getting teams", 500)
+			return
+		}
+		teams = append(teams, team)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("error scanning db rows:", err)
+		http.Error(w, "error getting teams", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(teams)
+}
+
+// createTeam creates a team from the JSON body, with members given by
+// username.
+func (s *Server) createTeam(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	s.saveTeam(w, req, 0)
+}
+
+// updateTeam replaces the name and members of a team with the JSON body.
+func (s *Server) updateTeam(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	id, err := strconv.ParseInt(params.ByName("id"), 10, 32)
+	if err != nil {
+		http.Error(w, "invalid team id", 400)
+		return
+	}
+	s.saveTeam(w, req, int32(id))
+}
+
+// saveTeam creates a team if id is zero and otherwise updates it, setting
+// its members in the same transaction.
+func (s *Server) saveTeam(w http.ResponseWriter, req *http.Request, id int32) {
+	var t Team
+	if err := json.NewDecoder(req.Body).Decode(&t); err != nil {
+		http.Error(w, "invalid JSON body", 400)
+		return
+	}
+	if t.Name == "" {
+		http.Error(w, "name is required", 400)
+		return
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		log.Println("error starting db transaction:", err)
+		http.Error(w, "error saving team", 500)
+		return
+	}
+	defer tx.Rollback()
+	if id == 0 {
+		err = tx.QueryRow("INSERT INTO teams (name) VALUES ($1) RETURNING id", t.Name).Scan(&id)
+	} else {
+		err = tx.QueryRow("UPDATE teams SET name = $1 WHERE id = $2 RETURNING id", t.Name, id).Scan(&id)
+	}
+	if err == pgx.ErrNoRows {
+		http.Error(w, "team not found", 404)
+		return
+	} else if postgres.IsUniquenessError(err, "teams_name_key") {
+		http.Error(w, "team already exists", 409)
+		return
+	} else if err != nil {
+		log.Println("error saving team:", err)
+		http.Error(w, "error saving team", 500)
+		return
+	}
+	if err := tx.Exec("DELETE FROM team_members WHERE team_id = $1", id); err != nil {
+		log.Println("error deleting team members:", err)
+		http.Error(w, "error saving team", 500)
+		return
+	}
+	for _, username := range t.Members {
+		var userID int32
+		err := tx.QueryRow("SELECT id FROM users WHERE username = $1", username).Scan(&userID)
+		if err == pgx.ErrNoRows {
+			http.Error(w, fmt.Sprintf("unknown user %q", username), 400)
+			return
+		} else if err != nil {
+			log.Println("error getting user from db:", err)
+			http.Error(w, "error saving team", 500)
+			return
+		}
+		if err := tx.Exec("INSERT INTO team_members (team_id, user_id) VALUES ($1, $2) ON CONFLICT DO NOTHING", id, userID); err != nil {
+			log.Println("error adding team member:", err)
+			http.Error(w, "error saving team", 500)
+			return
+		}
+	}
+	team, err := scanTeam(tx.QueryRow("SELECT "+teamColumns+" FROM teams WHERE id = $1", id))
+	if err != nil {
+		log.Println("error saving team:", err)
+		http.Error(w, "error saving team", 500)
+		return
+	}
+	action := AuditTeamUpdate
+	if req.Method == "POST" {
+		action = AuditTeamCreate
+	}
+	if !s.commitAudited(w, req, tx, &AuditEvent{Action: action, Details: map[string]interface{}{"team": team}}, "error saving team") {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if req.Method == "POST" {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(team)
+}
+
+// deleteTeam deletes a team along with the roles granted to it.
+func (s *Server) deleteTeam(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	s.deleteByID(w, req, params, "team", AuditTeamDelete, "DELETE FROM teams WHERE id = $1 RETURNING id")
+}
+
+func (s *Server) getRoleBindings(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	rows, err := s.db.Query("SELECT " + roleBindingColumns + " FROM " + roleBindingJoins + " ORDER BY role_bindings.id")
+	if err != nil {
+		log.Println("error getting roles from db:", err)
+		http.Error(w, "error getting roles", 500)
+		return
+	}
+	bindings := []*RoleBinding{}
+	for rows.Next() {
+		b, err := scanRoleBinding(rows)
+		if err != nil {
+			rows.Close()
+			log.Println("error scanning db row:", err)
+			http.Error(w, "error getting roles", 500)
+			return
+		}
+		bindings = append(bindings, b)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("error scanning db rows:", err)
+		http.Error(w, "error getting roles", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bindings)
+}
+
+// createRoleBinding grants a role from the JSON body, which names either a
+// user or a team, and either an app or a meta label.
+func (s *Server) createRoleBinding(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var b RoleBinding
+	if err := json.NewDecoder(req.Body).Decode(&b); err != nil {
+		http.Error(w, "invalid JSON body", 400)
+		return
+	}
+	if err := validateRoleBinding(&b); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	var userID, teamID *int32
+	var err error
+	if b.User != "" {
+		userID = new(int32)
+		err = s.db.QueryRow("SELECT id FROM users WHERE username = $1", b.User).Scan(userID)
+	} else {
+		teamID = new(int32)
+		err = s.db.QueryRow("SELECT id FROM teams WHERE name = $1", b.Team).Scan(teamID)
+	}
+	if err == pgx.ErrNoRows {
+		http.Error(w, "unknown user or team", 400)
+		return
+	} else if err != nil {
+		log.Println("error getting user or team from db:", err)
+		http.Error(w, "error creating role", 500)
+		return
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		log.Println("error starting db transaction:", err)
+		http.Error(w, "error creating role", 500)
+		return
+	}
+	defer tx.Rollback()
+	if err := tx.QueryRow(
+		"INSERT INTO role_bindings (user_id, team_id, role, app, label) VALUES ($1, $2, $3, $4, $5) RETURNING id, created_at",
+		userID, teamID, b.Role, b.App, b.Label,
+	).Scan(&b.ID, &b.CreatedAt); err != nil {
+		log.Println("error creating role:", err)
+		http.Error(w, "error creating role", 500)
+		return
+	}
+	var apps []string
+	if b.App != "" {
+		apps = []string{b.App}
+	}
+	if !s.commitAudited(w, req, tx, &AuditEvent{Action: AuditRoleCreate, Apps: apps, Details: map[string]interface{}{"role": b}}, "error creating role") {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(b)
+}
+
+func validateRoleBinding(b *RoleBinding) error {
+	if _, ok := roleLevels[b.Role]; !ok {
+		return fmt.Errorf("unknown role %q", b.Role)
+	}
+	if (b.User == "") == (b.Team == "") {
+		return fmt.Errorf("exactly one of user or team is required")
+	}
+	if (b.App == "") == (b.Label == "") {
+		return fmt.Errorf("exactly one of app or label is required")
+	}
+	if b.Label != "" {
+		if key, _, ok := splitLabel(b.Label); !ok || key == "" {
+			return fmt.Errorf("label must be formatted as key=value")
+		}
+	}
+	return nil
+}
+
+// deleteRoleBinding revokes a role.
+func (s *Server) deleteRoleBinding(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	s.deleteByID(w, req, params, "role", AuditRoleDelete, "DELETE FROM role_bindings WHERE id = $1 RETURNING id")
+}
+
+// deleteByID runs a query which deletes the row with the id from params,
+// responding with 204 No Content and auditing the action if it existed.
+func (s *Server) deleteByID(w http.ResponseWriter, req *http.Request, params httprouter.Params, kind, action, query string) {
+	id, err := strconv.ParseInt(params.ByName("id"), 10, 32)
+	if err != nil {
+		http.Error(w, "invalid "+kind+" id", 400)
+		return
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		log.Println("error starting db transaction:", err)
+		http.Error(w, "error deleting "+kind, 500)
+		return
+	}
+	defer tx.Rollback()
+	var deleted int32
+	err = tx.QueryRow(query, int32(id)).Scan(&deleted)
+	if err == pgx.ErrNoRows {
+		http.Error(w, kind+" not found", 404)
+		return
+	} else if err != nil {
+		log.Printf("error deleting %s: %s\n", kind, err)
+		http.Error(w, "error deleting "+kind, 500)
+		return
+	}
+	if !s.commitAudited(w, req, tx, &AuditEvent{Action: action, Details: map[string]interface{}{"id": deleted}}, "error deleting "+kind) {
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestRoles tests that users can only see and manage the apps they have
+// been granted a role for, either directly or via a team
+func TestRoles(t *testing.T) {
+	db, err := setupTestDB("flynn_webhook_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	client := newFakeAppClient("foo", "foo-staging", "bar")
+	client.apps[0].Meta = map[string]string{"team": "foo"}
+	client.apps[1].Meta = map[string]string{"team": "foo"}
+	srv := NewServer(db, client, nil)
+	if err := srv.setUserPassword("admin", "password", true); err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewServer(srv)
+	defer s.Close()
+
+	basicAuth := func(username, password string) string {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.SetBasicAuth(username, password)
+		return req.Header.Get("Authorization")
+	}
+	admin := basicAuth("admin", "password")
+	alice := basicAuth("alice", "alice-password")
+
+	for _, test := range []struct {
+		path   string
+		body   string
+		status int
+	}{
+		{"/users", `{"username":"alice","password":"alice-password"}`, http.StatusCreated},
+		{"/users", `{"username":"alice","password":"other"}`, http.StatusConflict},
+		{"/users", `{"username":"bob"}`, http.StatusBadRequest},
+		{"/teams", `{"name":"foo-team","members":["alice"]}`, http.StatusCreated},
+		{"/teams", `{"name":"bar-team","members":["bob"]}`, http.StatusBadRequest},
+		{"/roles", `{"team":"foo-team","role":"deployer","label":"team=foo"}`, http.StatusCreated},
+		{"/roles", `{"user":"alice","role":"admin","app":"foo-staging"}`, http.StatusCreated},
+		{"/roles", `{"user":"alice","role":"owner","app":"foo"}`, http.StatusBadRequest},
+		{"/roles", `{"user":"alice","team":"foo-team","role":"viewer","app":"foo"}`, http.StatusBadRequest},
+		{"/roles", `{"user":"alice","role":"viewer","label":"team"}`, http.StatusBadRequest},
+		{"/repos", `{"name":"lmars/foo","apps":["foo"]}`, http.StatusCreated},
+		{"/repos", `{"name":"lmars/bar","apps":["bar"]}`, http.StatusCreated},
+		{"/repos", `{"name":"lmars/bar","branch":"develop","apps":["bar"],"preview_template":"missing"}`, http.StatusBadRequest},
+	} {
+		res, err := sendAuthJSON("POST", s.URL+test.path, admin, test.body, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != test.status {
+			t.Fatalf("expected %d response for %s %s, got %s", test.status, test.path, test.body, res.Status)
+		}
+	}
+
+	// alice only sees the apps and repos of her team
+	var apps []struct{ Name string }
+	if _, err := sendAuthJSON("GET", s.URL+"/apps.json", alice, "", &apps); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(apps) != "[{foo} {foo-staging}]" {
+		t.Fatalf("unexpected apps: %v", apps)
+	}
+	var repos []*Repo
+	if _, err := sendAuthJSON("GET", s.URL+"/repos.json", alice, "", &repos); err != nil {
+		t.Fatal(err)
+	}
+	if len(repos) != 1 || repos[0].Name != "lmars/foo" {
+		t.Fatalf("expected only the lmars/foo repo, got %+v", repos)
+	}
+
+	for _, test := range []struct {
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"POST", "/repos", `{"name":"lmars/foo","branch":"develop","apps":["foo-staging"]}`, http.StatusCreated},
+		{"POST", "/repos", `{"name":"lmars/foo","branch":"release","apps":["foo"]}`, http.StatusForbidden},
+		{"POST", "/repos", `{"name":"lmars/bar","branch":"develop","apps":["bar"]}`, http.StatusForbidden},
+		{"POST", "/repos", `{"name":"lmars/foo","branch":"preview","apps":["foo-staging"],"preview_template":"foo"}`, http.StatusForbidden},
+		{"POST", "/repos", `{"name":"lmars/foo","branch":"preview","apps":["foo-staging"],"preview_template":"foo-staging"}`, http.StatusCreated},
+		{"PATCH", fmt.Sprintf("/repos/%d", repos[0].ID), `{"branch":"main"}`, http.StatusForbidden},
+		{"POST", fmt.Sprintf("/repos/%d/deploys", repos[0].ID), `{"commit":"a1b2c3","clone_url":"https://github.com/lmars/foo.git"}`, http.StatusCreated},
+		{"GET", "/deliveries", "", http.StatusForbidden},
+		{"GET", "/users.json", "", http.StatusForbidden},
+		{"POST", "/tokens", `{"name":"ci","scopes":["repos:read"]}`, http.StatusForbidden},
+	} {
+		res, err := sendAuthJSON(test.method, s.URL+test.path, alice, test.body, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != test.status {
+			t.Fatalf("expected %d response for %s %s, got %s", test.status, test.method, test.path, res.Status)
+		}
+	}
+
+	// alice loses access when removed from the team
+	var teams []*Team
+	if _, err := sendAuthJSON("GET", s.URL+"/teams.json", admin, "", &teams); err != nil {
+		t.Fatal(err)
+	}
+	if len(teams) != 1 || fmt.Sprint(teams[0].Members) != "[alice]" {
+		t.Fatalf("unexpected teams: %+v", teams)
+	}
+	res, err := sendAuthJSON("PUT", fmt.Sprintf("%s/teams/%d", s.URL, teams[0].ID), admin, `{"name":"foo-team","members":[]}`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected ok response, got %s", res.Status)
+	}
+	if _, err := sendAuthJSON("GET", s.URL+"/apps.json", alice, "", &apps); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(apps) != "[{foo-staging}]" {
+		t.Fatalf("unexpected apps after leaving the team: %v", apps)
+	}
+
+	// alice cannot delete a repo whose preview template she cannot manage
+	var preview Repo
+	res, err = sendAuthJSON("POST", s.URL+"/repos", admin, `{"name":"lmars/foo","branch":"pr","apps":["foo-staging"],"preview_template":"foo"}`, &preview)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("expected created response, got %s", res.Status)
+	}
+	res, err = sendAuthJSON("DELETE", fmt.Sprintf("%s/repos/%d", s.URL, preview.ID), alice, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected forbidden response deleting preview repo, got %s", res.Status)
+	}
+}
+
+// TestRoleForgedPush tests that a user who can add a rule for a repo with
+// their own secret cannot use that secret to deploy the apps of the other
+// rules for the repo
+func TestRoleForgedPush(t *testing.T) {
+	db, err := setupTestDB("flynn_webhook_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	srv := NewServer(db, newFakeAppClient("foo", "bar"), []byte("global"))
+	srv.secretBox, err = newSecretBox(testSecretKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.setUserPassword("admin", "password", true); err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewServer(srv)
+	defer s.Close()
+
+	basicAuth := func(username, password string) string {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.SetBasicAuth(username, password)
+		return req.Header.Get("Authorization")
+	}
+	admin := basicAuth("admin", "password")
+	alice := basicAuth("alice", "alice-password")
+
+	for _, test := range []struct {
+		auth string
+		path string
+		body string
+	}{
+		{admin, "/users", `{"username":"alice","password":"alice-password"}`},
+		{admin, "/roles", `{"user":"alice","role":"admin","app":"foo"}`},
+		{admin, "/repos", `{"name":"lmars/bar","branch":"master","apps":["bar"],"secret":"bar-secret"}`},
+		{alice, "/repos", `{"name":"lmars/bar","branch":"*","apps":["foo"],"secret":"alice-secret"}`},
+	} {
+		res, err := sendAuthJSON("POST", s.URL+test.path, test.auth, test.body, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusCreated {
+			t.Fatalf("expected created response for %s %s, got %s", test.path, test.body, res.Status)
+		}
+	}
+
+	event := Event{
+		Ref:        "refs/heads/master",
+		HeadCommit: Commit{ID: "a1b2c3"},
+		Repository: Repository{FullName: "lmars/bar", CloneURL: "https://example.com/evil.git"},
+	}
+	res, err := sendWebhook(s.URL, "push", event, []byte("alice-secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected ok response, got %s", res.Status)
+	}
+	var apps []string
+	if err := db.QueryRow("SELECT coalesce(array_agg(app ORDER BY app), '{}') FROM deploys").Scan(&apps); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(apps) != "[foo]" {
+		t.Fatalf("expected only a deploy to foo, got %v", apps)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx"
+	"github.com/julienschmidt/httprouter"
+)
+
+// defaultSecretGracePeriod is how long the previous secret of a repo
+// remains valid after the secret is rotated, giving time to update the
+// webhook config.
+const defaultSecretGracePeriod = 24 * time.Hour
+
+// secretBox encrypts per-repo webhook secrets before they are stored in the
+// db, since they are needed in plain text to verify webhook signatures.
+type secretBox struct {
+	aead cipher.AEAD
+}
+
+// newSecretBox returns a secretBox which uses AES-256-GCM with the given
+// hex encoded 32 byte key.
+func newSecretBox(hexKey string) (*secretBox, error) {
+	key, err := hex.DecodeString(hexKey)
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("secret key must be 32 hex encoded bytes")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &secretBox{aead}, nil
+}
+
+// Seal encrypts the secret, prefixing the result with a random nonce.
+func (b *secretBox) Seal(secret []byte) ([]byte, error) {
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return b.aead.Seal(nonce, nonce, secret, nil), nil
+}
+
+// Open decrypts a secret encrypted with Seal.
+func (b *secretBox) Open(data []byte) ([]byte, error) {
+	n := b.aead.NonceSize()
+	if len(data) < n {
+		return nil, errors.New("encrypted secret too short")
+	}
+	return b.aead.Open(nil, data[:n], data[n:], nil)
+}
+
+// ruleSecrets are the secrets which are valid for webhooks deploying a
+// repo rule, with a zero RepoID for webhooks which match no rules.
+type ruleSecrets struct {
+	RepoID  int32
+	Secrets [][]byte
+}
+
+// getRepoSecrets returns the secrets which are valid for webhooks sent by
+// each rule of the named repo on the given provider, using the global
+// secret token for rules which do not have their own secret, and including
+// previous secrets which are still within their grace period.
+//
+// Only the global secret token is used if the name is empty (e.g. for ping
+// events sent by organization webhooks) or no rules match the name.
+func (s *Server) getRepoSecrets(provider, name string) ([]ruleSecrets, error) {
+	global := []ruleSecrets{{Secrets: [][]byte{s.secretToken}}}
+	if name == "" {
+		return global, nil
+	}
+	rows, err := s.db.Query("SELECT id, secret, previous_secret, previous_secret_expires_at > now() FROM repos WHERE provider = $1 AND name = $2 ORDER BY id", provider, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var rules []ruleSecrets
+	for rows.Next() {
+		var rule ruleSecrets
+		var secret, previous []byte
+		var previousValid *bool
+		if err := rows.Scan(&rule.RepoID, &secret, &previous, &previousValid); err != nil {
+			return nil, err
+		}
+		encrypted := [][]byte{secret}
+		if previousValid != nil && *previousValid {
+			encrypted = append(encrypted, previous)
+		}
+		for _, data := range encrypted {
+			if data == nil {
+				rule.Secrets = append(rule.Secrets, s.secretToken)
+				continue
+			}
+			if s.secretBox == nil {
+				return nil, errors.New("repo has a secret but REPO_SECRET_KEY is not set")
+			}
+			secret, err := s.secretBox.Open(data)
+			if err != nil {
+				return nil, err
+			}
+			rule.Secrets = append(rule.Secrets, secret)
+		}
+		rules = append(rules, rule)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(rules) == 0 {
+		return global, nil
+	}
+	return rules, nil
+}
+
+// setRepoSecret sets the webhook secret of a repo, keeping the previous
+// secret (or the global secret token if it did not have one) valid for
+// the given grace period.
+func (s *Server) setRepoSecret(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	repo := s.loadRepo(w, params)
+	if repo == nil || !checkApps(w, req, ScopeReposWrite, repo.Apps...) {
+		return
+	}
+	secret := req.FormValue("secret")
+	if secret == "" {
+		http.Error(w, "secret is required", 400)
+		return
+	}
+	gracePeriod := defaultSecretGracePeriod
+	if v := req.FormValue("grace_period"); v != "" {
+		var err error
+		gracePeriod, err = time.ParseDuration(v)
+		if err != nil || gracePeriod < 0 {
+			http.Error(w, "invalid grace_period", 400)
+			return
+		}
+	}
+	if s.secretBox == nil {
+		http.Error(w, "per-repo secrets require REPO_SECRET_KEY to be set", 400)
+		return
+	}
+	encrypted, err := s.secretBox.Seal([]byte(secret))
+	if err != nil {
+		log.Println("error encrypting repo secret:", err)
+		http.Error(w, "error setting repo secret", 500)
+		return
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		log.Println("error starting db transaction:", err)
+		http.Error(w, "error setting repo secret", 500)
+		return
+	}
+	defer tx.Rollback()
+	var updated int32
+	err = tx.QueryRow(
+		`UPDATE repos SET previous_secret = secret, previous_secret_expires_at = now() + $1 * interval '1 second', secret = $2 WHERE id = $3 RETURNING id`,
+		int64(gracePeriod/time.Second), encrypted, repo.ID,
+	).Scan(&updated)
+	if err == pgx.ErrNoRows {
+		http.Error(w, "repo not found", 404)
+		return
+	} else if err != nil {
+		log.Println("error setting repo secret:", err)
+		http.Error(w, "error setting repo secret", 500)
+		return
+	}
+	if !s.commitAudited(w, req, tx, &AuditEvent{
+		Action:  AuditRepoSecret,
+		Apps:    repo.Apps,
+		RepoID:  &repo.ID,
+		Details: map[string]interface{}{"grace_period": gracePeriod.String()},
+	}, "error setting repo secret") {
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+const testSecretKey = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+
+// TestSecretBox tests that secrets can be encrypted and decrypted
+func TestSecretBox(t *testing.T) {
+	box, err := newSecretBox(testSecretKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := box.Seal([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("secret")) {
+		t.Fatal("expected secret to be encrypted")
+	}
+	secret, err := box.Open(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(secret) != "secret" {
+		t.Fatalf(`expected secret "secret", got %q`, secret)
+	}
+	data[len(data)-1] ^= 1
+	if _, err := box.Open(data); err == nil {
+		t.Fatal("expected error opening modified secret")
+	}
+	if _, err := newSecretBox("0102"); err == nil {
+		t.Fatal("expected error creating secret box with short key")
+	}
+}
+
+// TestRepoSecret tests that webhooks for repos with their own secret are
+// checked against that secret, and that the previous secret remains valid
+// after rotation
+func TestRepoSecret(t *testing.T) {
+	db, err := setupTestDB("flynn_webhook_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	globalToken := []byte("global")
+	srv := newTestServer(db, newFakeAppClient("foo"), globalToken)
+	srv.secretBox, err = newSecretBox(testSecretKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewServer(srv)
+	defer s.Close()
+
+	data := strings.NewReader("name=lmars/foo&branch=master&app=foo&secret=repo-secret")
+	res, err := http.Post(s.URL+"/repos", "application/x-www-form-urlencoded", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	ping := Event{Repository: Repository{FullName: "lmars/foo"}}
+	assertStatus := func(secret string, status int) {
+		res, err := sendWebhook(s.URL, "ping", ping, []byte(secret))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != status {
+			t.Fatalf("expected status %d for secret %q, got %s", status, secret, res.Status)
+		}
+	}
+	assertStatus("repo-secret", 200)
+	assertStatus("global", 400)
+
+	var id int32
+	if err := db.QueryRow("SELECT id FROM repos WHERE name = 'lmars/foo'").Scan(&id); err != nil {
+		t.Fatal(err)
+	}
+	rotate := func(secret, gracePeriod string) {
+		form := url.Values{"secret": {secret}, "grace_period": {gracePeriod}}
+		req, err := http.NewRequest("PUT", fmt.Sprintf("%s/repos/%d/secret", s.URL, id), strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusNoContent {
+			t.Fatalf("expected no content response, got %s", res.Status)
+		}
+	}
+
+	rotate("new-secret", "1h")
+	assertStatus("new-secret", 200)
+	assertStatus("repo-secret", 200)
+
+	rotate("newer-secret", "0s")
+	assertStatus("newer-secret", 200)
+	assertStatus("new-secret", 400)
+}
+
+// TestRepoSecretPerRule tests that webhooks only deploy the rules whose
+// secret they were signed with, with the global secret only being valid for
+// rules without their own secret
+func TestRepoSecretPerRule(t *testing.T) {
+	db, err := setupTestDB("flynn_webhook_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	globalToken := []byte("global")
+	srv := newTestServer(db, newFakeAppClient("foo", "bar"), globalToken)
+	srv.secretBox, err = newSecretBox(testSecretKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewServer(srv)
+	defer s.Close()
+
+	for _, form := range []string{
+		"name=lmars/foo&branch=master&app=foo&secret=repo-secret",
+		"name=lmars/foo&branch=*&app=bar",
+	} {
+		res, err := http.Post(s.URL+"/repos", "application/x-www-form-urlencoded", strings.NewReader(form))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("expected ok response, got %s", res.Status)
+		}
+	}
+
+	for i, test := range []struct {
+		secret string
+		status int
+		apps   string
+	}{
+		{secret: "global", status: 200, apps: "[bar]"},
+		{secret: "repo-secret", status: 200, apps: "[foo]"},
+		{secret: "invalid", status: 400, apps: "[]"},
+	} {
+		if err := db.Exec("DELETE FROM deploys"); err != nil {
+			t.Fatal(err)
+		}
+		event := Event{
+			Ref:        "refs/heads/master",
+			HeadCommit: Commit{ID: fmt.Sprintf("a%d", i)},
+			Repository: Repository{FullName: "lmars/foo", CloneURL: "https://github.com/lmars/foo.git"},
+		}
+		res, err := sendWebhook(s.URL, "push", event, []byte(test.secret))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != test.status {
+			t.Fatalf("expected status %d for secret %q, got %s", test.status, test.secret, res.Status)
+		}
+
+		var apps []string
+		if err := db.QueryRow("SELECT coalesce(array_agg(app ORDER BY app), '{}') FROM deploys").Scan(&apps); err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(apps) != test.apps {
+			t.Fatalf("expected deploys to %s for secret %q, got %v", test.apps, test.secret, apps)
+		}
+
+		// replaying the delivery only deploys the rules whose secret
+		// it was sent with
+		if test.status != 200 {
+			continue
+		}
+		var id int32
+		if err := db.QueryRow("SELECT id FROM deliveries ORDER BY id DESC LIMIT 1").Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Exec("DELETE FROM deploys"); err != nil {
+			t.Fatal(err)
+		}
+		res, err = http.Post(fmt.Sprintf("%s/deliveries/%d/replay", s.URL, id), "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("expected ok response replaying delivery %d, got %s", id, res.Status)
+		}
+		if err := db.QueryRow("SELECT coalesce(array_agg(app ORDER BY app), '{}') FROM deploys").Scan(&apps); err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(apps) != test.apps {
+			t.Fatalf("expected replay to deploy to %s for secret %q, got %v", test.apps, test.secret, apps)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// skipDirective matches markers in commit messages which skip deploying
+// the commit, such as "[skip deploy]" or "[ci skip]".
+var skipDirective = regexp.MustCompile(`(?i)\[(skip deploy|deploy skip|skip ci|ci skip)\]`)
+
+// skipReason returns why the push event should not be deployed, or an
+// empty string if it should be.
+//
+// Only the head commit is checked unless all is set, in which case a
+// directive in any commit of the push skips the deploy.
+func skipReason(event *Event, all bool) string {
+	commits := []Commit{event.HeadCommit}
+	if all {
+		commits = append(commits, event.Commits...)
+	}
+	for _, commit := range commits {
+		if directive := skipDirective.FindString(commit.Message); directive != "" {
+			return fmt.Sprintf("commit %s contains %s", shortCommit(commit.ID), directive)
+		}
+	}
+	return ""
+}
+
+// shortCommit returns the abbreviated form of a commit SHA.
+func shortCommit(id string) string {
+	if len(id) > 7 {
+		return id[:7]
+	}
+	return id
+}
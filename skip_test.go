@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+// TestSkipReason tests that skip directives in the head commit, or any
+// commit if all is set, skip deploying the push
+func TestSkipReason(t *testing.T) {
+	for _, test := range []struct {
+		desc    string
+		head    string
+		other   string
+		all     bool
+		skipped bool
+	}{
+		{desc: "no directive", head: "Fix bug"},
+		{desc: "skip deploy", head: "Update docs [skip deploy]", skipped: true},
+		{desc: "deploy skip", head: "Update docs [deploy skip]", skipped: true},
+		{desc: "ci skip", head: "[ci skip] Update docs", skipped: true},
+		{desc: "skip ci uppercase", head: "Update docs\n\n[SKIP CI]", skipped: true},
+		{desc: "without brackets", head: "skip deploy"},
+		{desc: "other commit", head: "Fix bug", other: "Update docs [skip deploy]"},
+		{desc: "other commit with all", head: "Fix bug", other: "Update docs [skip deploy]", all: true, skipped: true},
+	} {
+		event := &Event{
+			HeadCommit: Commit{ID: "a1b2c3d4e5", Message: test.head},
+			Commits: []Commit{
+				{ID: "f6f7f8f9", Message: test.other},
+				{ID: "a1b2c3d4e5", Message: test.head},
+			},
+		}
+		reason := skipReason(event, test.all)
+		if skipped := reason != ""; skipped != test.skipped {
+			t.Fatalf("%s: expected skipped=%t, got reason %q", test.desc, test.skipped, reason)
+		}
+	}
+
+	event := &Event{HeadCommit: Commit{ID: "a1b2c3d4e5", Message: "Update docs [skip deploy]"}}
+	if reason := skipReason(event, false); reason != "commit a1b2c3d contains [skip deploy]" {
+		t.Fatalf("unexpected skip reason: %q", reason)
+	}
+}
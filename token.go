@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/flynn/flynn/pkg/postgres"
+	"github.com/jackc/pgx"
+	"github.com/julienschmidt/httprouter"
+)
+
+// API token scopes.
+const (
+	ScopeReposRead      = "repos:read"
+	ScopeReposWrite     = "repos:write"
+	ScopeDeploysRead    = "deploys:read"
+	ScopeDeploysTrigger = "deploys:trigger"
+)
+
+var tokenScopes = []string{ScopeReposRead, ScopeReposWrite, ScopeDeploysRead, ScopeDeploysTrigger}
+
+// APIToken is a token used by scripts and CI jobs to call the JSON API,
+// limited to the given scopes and, if Apps is not empty, to those apps.
+//
+// Only a hash of the token is stored, so Token is only set in the response
+// to creating it.
+type APIToken struct {
+	ID         int32      `json:"id"`
+	Name       string     `json:"name"`
+	Token      string     `json:"token,omitempty"`
+	Scopes     []string   `json:"scopes"`
+	Apps       []string   `json:"apps"`
+	UserID     *int32     `json:"user_id,omitempty"`
+	CreatedAt  *time.Time `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+}
+
+const apiTokenColumns = "id, name, scopes, apps, user_id, created_at, last_used_at, revoked_at"
+
+func scanAPIToken(s postgres.Scanner) (*APIToken, error) {
+	t := &APIToken{}
+	return t, s.Scan(&t.ID, &t.Name, &t.Scopes, &t.Apps, &t.UserID, &t.CreatedAt, &t.LastUsedAt, &t.RevokedAt)
+}
+
+// Caller is the user or API token which made a request. Admin users can do
+// anything, as can callers when authentication is disabled, whereas other
+// users can only access apps they have been granted a role for.
+type Caller struct {
+	User  *User
+	Token *APIToken
+
+	// appRoles is the role a non-admin user has for each app they can
+	// access
+	appRoles map[string]string
+
+	// sessionToken is set if the user was authenticated by their login
+	// session, in which case requests which change state must include
+	// the session's CSRF token
+	sessionToken string
+}
+
+// HasScope returns whether the caller has the scope, which API tokens never
+// have if the scope is empty.
+func (c *Caller) HasScope(scope string) bool {
+	if c.Token == nil {
+		return true
+	}
+	if scope == "" {
+		return false
+	}
+	for _, s := range c.Token.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAdmin returns whether the caller can manage users, teams and API
+// tokens.
+func (c *Caller) IsAdmin() bool {
+	return c.Token == nil && (c.User == nil || c.User.Admin)
+}
+
+// Unrestricted returns whether the caller can access all apps.
+func (c *Caller) Unrestricted() bool {
+	if c.Token != nil {
+		return len(c.Token.Apps) == 0
+	}
+	return c.IsAdmin()
+}
+
+// CanAccessApps returns whether the caller can use the scope for all of the
+// apps, which for users depends on their role for each app.
+func (c *Caller) CanAccessApps(scope string, apps ...string) bool {
+	if !c.HasScope(scope) {
+		return false
+	}
+	if c.Unrestricted() {
+		return true
+	}
+	if c.Token != nil {
+		allowed := make(map[string]bool, len(c.Token.Apps))
+		for _, app := range c.Token.Apps {
+			allowed[app] = true
+		}
+		for _, app := range apps {
+			if !allowed[app] {
+				return false
+			}
+		}
+		return true
+	}
+	for _, app := range apps {
+		if !roleAllows(c.appRoles[app], scope) {
+			return false
+		}
+	}
+	return true
+}
+
+type callerContextKey struct{}
+
+// requestCaller returns the caller who made the request.
+func requestCaller(req *http.Request) *Caller {
+	if caller, ok := req.Context().Value(callerContextKey{}).(*Caller); ok {
+		return caller
+	}
+	return &Caller{}
+}
+
+// scoped returns a handle which responds with 403 Forbidden unless the
+// caller has the scope, so that an empty scope only allows users.
+func scoped(scope string, h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		if !requestCaller(req).HasScope(scope) {
+			if scope == "" {
+				http.Error(w, "API tokens cannot be used for this request", 403)
+			} else {
+				http.Error(w, "API token does not have the "+scope+" scope", 403)
+			}
+			return
+		}
+		h(w, req, params)
+	}
+}
+
+// checkApps writes a 403 Forbidden response and returns false if the caller
+// cannot use the scope for all of the apps.
+func checkApps(w http.ResponseWriter, req *http.Request, scope string, apps ...string) bool {
+	if !requestCaller(req).CanAccessApps(scope, apps...) {
+		http.Error(w, "not allowed to access the app", 403)
+		return false
+	}
+	return true
+}
+
+// checkUnrestricted writes a 403 Forbidden response and returns false if
+// the caller cannot access all apps, for requests which are not limited to
+// particular apps.
+func checkUnrestricted(w http.ResponseWriter, req *http.Request) bool {
+	if !requestCaller(req).Unrestricted() {
+		http.Error(w, "access to all apps is required for this request", 403)
+		return false
+	}
+	return true
+}
+
+// authenticateToken returns the caller for the unrevoked API token, or nil
+// if the token is invalid.
+func (s *Server) authenticateToken(token string) (*Caller, error) {
+	t, err := scanAPIToken(s.db.QueryRow(
+		"UPDATE api_tokens SET last_used_at = now() WHERE token_hash = $1 AND revoked_at IS NULL RETURNING "+apiTokenColumns,
+		hashToken(token),
+	))
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &Caller{Token: t}, nil
+}
+
+func (s *Server) getAPITokens(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	rows, err := s.db.Query("SELECT " + apiTokenColumns + " FROM api_tokens ORDER BY id")
+	if err != nil {
+		log.Println("error getting API tokens from db:", err)
+		http.Error(w, "error getting API tokens", 500)
+		return
+	}
+	tokens := []*APIToken{}
+	for rows.Next() {
+		token, err := scanAPIToken(rows)
+		if err != nil {
+			rows.Close()
+			log.Println("error scanning db row:", err)
+			http.Error(w, "error getting API tokens", 500)
+			return
+		}
+		tokens = append(tokens, token)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("error scanning db rows:", err)
+		http.Error(w, "error getting API tokens", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// createAPIToken creates an API token from the JSON body, responding with
+// the token which cannot be retrieved again.
+func (s *Server) createAPIToken(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var t APIToken
+	if err := json.NewDecoder(req.Body).Decode(&t); err != nil {
+		http.Error(w, "invalid JSON body", 400)
+		return
+	}
+	if t.Name == "" {
+		http.Error(w, "name is required", 400)
+		return
+	}
+	if len(t.Scopes) == 0 {
+		http.Error(w, "at least one scope is required", 400)
+		return
+	}
+	for _, scope := range t.Scopes {
+		if !validScope(scope) {
+			http.Error(w, fmt.Sprintf("unknown scope %q", scope), 400)
+			return
+		}
+	}
+	if t.Apps == nil {
+		t.Apps = []string{}
+	}
+	if user := requestCaller(req).User; user != nil {
+		t.UserID = &user.ID
+	}
+	token, err := randomToken()
+	if err != nil {
+		log.Println("error generating API token:", err)
+		http.Error(w, "error creating API token", 500)
+		return
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		log.Println("error starting db transaction:", err)
+		http.Error(w, "error creating API token", 500)
+		return
+	}
+	defer tx.Rollback()
+	if err := tx.QueryRow(
+		"INSERT INTO api_tokens (name, token_hash, scopes, apps, user_id) VALUES ($1, $2, $3, $4, $5) RETURNING id, created_at",
+		t.Name, hashToken(token), t.Scopes, t.Apps, t.UserID,
+	).Scan(&t.ID, &t.CreatedAt); err != nil {
+		log.Println("error creating API token:", err)
+		http.Error(w, "error creating API token", 500)
+		return
+	}
+	t.LastUsedAt = nil
+	t.RevokedAt = nil
+	if !s.commitAudited(w, req, tx, &AuditEvent{Action: AuditTokenCreate, Apps: t.Apps, Details: map[string]interface{}{"token": t}}, "error creating API token") {
+		return
+	}
+	t.Token = token
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(t)
+}
+
+// revokeAPIToken revokes an API token, keeping it in the db so that its
+// use can still be traced.
+func (s *Server) revokeAPIToken(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	id, err := strconv.ParseInt(params.ByName("id"), 10, 32)
+	if err != nil {
+		http.Error(w, "invalid token id", 400)
+		return
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		log.Println("error starting db transaction:", err)
+		http.Error(w, "error revoking API token", 500)
+		return
+	}
+	defer tx.Rollback()
+	var revoked int32
+	err = tx.QueryRow("UPDATE api_tokens SET revoked_at = now() WHERE id = $1 AND revoked_at IS NULL RETURNING id", int32(id)).Scan(&revoked)
+	if err == pgx.ErrNoRows {
+		http.Error(w, "token not found", 404)
+		return
+	} else if err != nil {
+		log.Println("error revoking API token:", err)
+		http.Error(w, "error revoking API token", 500)
+		return
+	}
+	if !s.commitAudited(w, req, tx, &AuditEvent{Action: AuditTokenRevoke, Details: map[string]interface{}{"id": revoked}}, "error revoking API token") {
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func validScope(scope string) bool {
+	for _, s := range tokenScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
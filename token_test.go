@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCallerPermissions(t *testing.T) {
+	admin := &Caller{User: &User{ID: 1, Admin: true}}
+	user := &Caller{User: &User{ID: 2}, appRoles: map[string]string{"foo": RoleAdmin, "bar": RoleDeployer, "baz": RoleViewer}}
+	token := &Caller{Token: &APIToken{Scopes: []string{ScopeReposRead}}}
+	restricted := &Caller{Token: &APIToken{Scopes: []string{ScopeReposRead, ScopeDeploysRead}, Apps: []string{"foo", "bar"}}}
+
+	for _, test := range []struct {
+		caller *Caller
+		scope  string
+		apps   []string
+		scoped bool
+		access bool
+	}{
+		{caller: admin, scope: ScopeReposWrite, apps: []string{"foo", "qux"}, scoped: true, access: true},
+		{caller: admin, scope: "", scoped: true, access: true},
+		{caller: &Caller{}, scope: "", scoped: true, access: true},
+		{caller: user, scope: ScopeReposWrite, apps: []string{"foo"}, scoped: true, access: true},
+		{caller: user, scope: ScopeReposWrite, apps: []string{"foo", "bar"}, scoped: true, access: false},
+		{caller: user, scope: ScopeDeploysTrigger, apps: []string{"foo", "bar"}, scoped: true, access: true},
+		{caller: user, scope: ScopeDeploysTrigger, apps: []string{"baz"}, scoped: true, access: false},
+		{caller: user, scope: ScopeDeploysRead, apps: []string{"foo", "bar", "baz"}, scoped: true, access: true},
+		{caller: user, scope: ScopeReposRead, apps: []string{"qux"}, scoped: true, access: false},
+		{caller: token, scope: ScopeReposRead, apps: []string{"baz"}, scoped: true, access: true},
+		{caller: token, scope: ScopeReposWrite, scoped: false, access: false},
+		{caller: token, scope: "", scoped: false, access: false},
+		{caller: restricted, scope: ScopeDeploysRead, apps: []string{"foo", "bar"}, scoped: true, access: true},
+		{caller: restricted, scope: ScopeDeploysRead, apps: []string{"foo", "baz"}, scoped: true, access: false},
+		{caller: restricted, scope: ScopeDeploysTrigger, apps: []string{"foo"}, scoped: false, access: false},
+	} {
+		if scoped := test.caller.HasScope(test.scope); scoped != test.scoped {
+			t.Fatalf("expected HasScope(%q) to be %t for %+v", test.scope, test.scoped, test.caller)
+		}
+		if access := test.caller.CanAccessApps(test.scope, test.apps...); access != test.access {
+			t.Fatalf("expected CanAccessApps(%q, %v) to be %t for %+v", test.scope, test.apps, test.access, test.caller)
+		}
+	}
+}
+
+// TestAPITokens tests that API tokens can only be used for the scopes and
+// apps they are created with
+func TestAPITokens(t *testing.T) {
+	db, err := setupTestDB("flynn_webhook_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	srv := NewServer(db, newFakeAppClient("foo", "bar"), nil)
+	if err := srv.setUserPassword("admin", "password", true); err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewServer(srv)
+	defer s.Close()
+
+	req, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("admin", "password")
+	basic := req.Header.Get("Authorization")
+
+	for _, body := range []string{
+		`{"name":"lmars/foo","apps":["foo"]}`,
+		`{"name":"lmars/bar","apps":["bar"]}`,
+	} {
+		res, err := sendAuthJSON("POST", s.URL+"/repos", basic, body, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusCreated {
+			t.Fatalf("expected 201 response, got %s", res.Status)
+		}
+	}
+
+	for _, body := range []string{`{"scopes":["repos:read"]}`, `{"name":"ci"}`, `{"name":"ci","scopes":["repos:admin"]}`} {
+		res, err := sendAuthJSON("POST", s.URL+"/tokens", basic, body, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected 400 response for %s, got %s", body, res.Status)
+		}
+	}
+
+	var token APIToken
+	res, err := sendAuthJSON("POST", s.URL+"/tokens", basic, `{"name":"ci","scopes":["repos:read","repos:write"],"apps":["foo"]}`, &token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201 response, got %s", res.Status)
+	}
+	if token.Token == "" {
+		t.Fatal("expected the token to be returned")
+	}
+	bearer := "Bearer " + token.Token
+
+	// the token only sees repos of its apps
+	var repos []Repo
+	res, err = sendAuthJSON("GET", s.URL+"/repos.json", bearer, "", &repos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected ok response, got %s", res.Status)
+	}
+	if len(repos) != 1 || repos[0].Name != "lmars/foo" {
+		t.Fatalf("expected only the lmars/foo repo, got %+v", repos)
+	}
+
+	for _, test := range []struct {
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"POST", "/repos", `{"name":"lmars/foo","branch":"develop","apps":["foo"]}`, http.StatusCreated},
+		{"POST", "/repos", `{"name":"lmars/bar","branch":"develop","apps":["bar"]}`, http.StatusForbidden},
+		{"GET", fmt.Sprintf("/repos/%d", repos[0].ID), "", http.StatusOK},
+		{"PATCH", fmt.Sprintf("/repos/%d", repos[0].ID), `{"apps":["bar"]}`, http.StatusForbidden},
+		{"GET", "/deploys.json", "", http.StatusForbidden},
+		{"GET", "/deliveries", "", http.StatusForbidden},
+		{"GET", "/tokens.json", "", http.StatusForbidden},
+		{"POST", "/tokens", `{"name":"other","scopes":["repos:read"]}`, http.StatusForbidden},
+		{"GET", "/", "", http.StatusForbidden},
+	} {
+		res, err := sendAuthJSON(test.method, s.URL+test.path, bearer, test.body, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != test.status {
+			t.Fatalf("expected %d response for %s %s, got %s", test.status, test.method, test.path, res.Status)
+		}
+	}
+
+	var tokens []*APIToken
+	if _, err := sendAuthJSON("GET", s.URL+"/tokens.json", basic, "", &tokens); err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 1 || tokens[0].Token != "" || tokens[0].LastUsedAt == nil {
+		t.Fatalf("unexpected tokens: %+v", tokens)
+	}
+
+	res, err = sendAuthJSON("DELETE", fmt.Sprintf("%s/tokens/%d", s.URL, token.ID), basic, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204 response, got %s", res.Status)
+	}
+	res, err = sendAuthJSON("GET", s.URL+"/repos.json", bearer, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 response for a revoked token, got %s", res.Status)
+	}
+}
@@ -1,24 +1,23 @@
 package main
 
 import (
-	"bytes"
-	"crypto/hmac"
-	"crypto/sha1"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
-	"path"
+	"strings"
+	"text/template"
 	"time"
 
 	"github.com/flynn/flynn/controller/client"
 	ct "github.com/flynn/flynn/controller/types"
 	"github.com/flynn/flynn/discoverd/client"
-	"github.com/flynn/flynn/pkg/cluster"
+	"github.com/flynn/flynn/pkg/cors"
 	"github.com/flynn/flynn/pkg/postgres"
+	"github.com/flynn/flynn/pkg/random"
 	"github.com/julienschmidt/httprouter"
 )
 
@@ -45,6 +44,48 @@ func run() error {
 	}
 
 	server := NewServer(db, client, []byte(secretToken))
+	server.allowSHA1 = os.Getenv("ALLOW_SHA1_SIGNATURE") == "true"
+	server.requireSHA256 = os.Getenv("REQUIRE_SHA256_SIGNATURE") == "true"
+	server.skipAllCommits = os.Getenv("SKIP_ALL_COMMITS") == "true"
+	server.previewDomainSuffix = os.Getenv("PREVIEW_DOMAIN")
+	server.behindRouter = os.Getenv("BEHIND_FLYNN_ROUTER") == "true"
+	if v := os.Getenv("CORS_ALLOWED_ORIGINS"); v != "" {
+		server.allowedOrigins = strings.Split(v, ",")
+	}
+	if v := os.Getenv("DEDUP_WINDOW"); v != "" {
+		server.dedupWindow, err = time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid DEDUP_WINDOW: %s", err)
+		}
+	}
+	if v := os.Getenv("DELIVERY_RETENTION"); v != "" {
+		server.deliveryRetention, err = time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid DELIVERY_RETENTION: %s", err)
+		}
+	}
+	if key := os.Getenv("REPO_SECRET_KEY"); key != "" {
+		server.secretBox, err = newSecretBox(key)
+		if err != nil {
+			return fmt.Errorf("invalid REPO_SECRET_KEY: %s", err)
+		}
+	}
+	if path := os.Getenv("REPO_CONFIG"); path != "" {
+		if err := server.syncConfigFile(path); err != nil {
+			return fmt.Errorf("error syncing REPO_CONFIG: %s", err)
+		}
+	}
+	if password := os.Getenv("ADMIN_PASSWORD"); password != "" {
+		username := os.Getenv("ADMIN_USERNAME")
+		if username == "" {
+			username = "admin"
+		}
+		if err := server.setUserPassword(username, password, true); err != nil {
+			return fmt.Errorf("error setting ADMIN_PASSWORD: %s", err)
+		}
+	}
+	go server.runDeploys()
+	go server.pruneDeliveries()
 
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -66,6 +107,177 @@ func setupDB(db *postgres.DB) error {
 	created_at timestamp with time zone NOT NULL DEFAULT current_timestamp,
 	UNIQUE (name, branch)
 	);`)
+	m.Add(2,
+		`CREATE TABLE deploys (
+	id serial PRIMARY KEY,
+	repo_id integer NOT NULL,
+	repo text NOT NULL,
+	clone_url text NOT NULL,
+	app text NOT NULL,
+	branch text NOT NULL,
+	commit text NOT NULL,
+	state text NOT NULL DEFAULT 'pending',
+	error text,
+	created_at timestamp with time zone NOT NULL DEFAULT current_timestamp,
+	started_at timestamp with time zone,
+	finished_at timestamp with time zone,
+	worker_id text,
+	lease_expires_at timestamp with time zone
+	);`,
+		`CREATE INDEX deploys_state_idx ON deploys (state);`)
+	m.Add(3,
+		`ALTER TABLE deploys ADD COLUMN exit_status integer;`,
+		`CREATE INDEX deploys_repo_id_idx ON deploys (repo_id);`)
+	m.Add(4,
+		`CREATE TABLE deploy_logs (
+	id bigserial PRIMARY KEY,
+	deploy_id integer NOT NULL REFERENCES deploys (id) ON DELETE CASCADE,
+	stream text NOT NULL,
+	data text NOT NULL,
+	created_at timestamp with time zone NOT NULL DEFAULT current_timestamp
+	);`,
+		`CREATE INDEX deploy_logs_deploy_id_idx ON deploy_logs (deploy_id, id);`)
+	m.Add(5,
+		`ALTER TABLE repos ADD COLUMN secret bytea;`,
+		`ALTER TABLE repos ADD COLUMN previous_secret bytea;`,
+		`ALTER TABLE repos ADD COLUMN previous_secret_expires_at timestamp with time zone;`)
+	m.Add(6,
+		`ALTER TABLE deploys ADD COLUMN delivery_id text NOT NULL DEFAULT '';`,
+		`CREATE INDEX deploys_delivery_id_idx ON deploys (delivery_id);`,
+		`CREATE INDEX deploys_commit_idx ON deploys (repo, branch, commit);`)
+	m.Add(7,
+		`CREATE TABLE deliveries (
+	id serial PRIMARY KEY,
+	delivery_id text NOT NULL DEFAULT '',
+	event text NOT NULL DEFAULT '',
+	headers jsonb NOT NULL,
+	body bytea NOT NULL,
+	signature_valid boolean NOT NULL DEFAULT false,
+	status_code integer NOT NULL,
+	response text NOT NULL DEFAULT '',
+	deploy_id integer REFERENCES deploys (id) ON DELETE SET NULL,
+	replay_of integer REFERENCES deliveries (id) ON DELETE SET NULL,
+	repo_ids integer[] NOT NULL DEFAULT '{}',
+	created_at timestamp with time zone NOT NULL DEFAULT current_timestamp
+	);`,
+		`CREATE INDEX deliveries_created_at_idx ON deliveries (created_at);`)
+	m.Add(8,
+		`ALTER TABLE repos ADD COLUMN provider text NOT NULL DEFAULT 'github';`,
+		`ALTER TABLE repos DROP CONSTRAINT repos_name_branch_key;`,
+		`ALTER TABLE repos ADD CONSTRAINT repos_provider_name_branch_key UNIQUE (provider, name, branch);`,
+		`ALTER TABLE deploys ADD COLUMN provider text NOT NULL DEFAULT 'github';`,
+		`ALTER TABLE deliveries ADD COLUMN provider text NOT NULL DEFAULT '';`)
+	m.Add(9,
+		`ALTER TABLE repos ADD COLUMN tag_pattern text NOT NULL DEFAULT '';`,
+		`ALTER TABLE repos DROP CONSTRAINT repos_provider_name_branch_key;`,
+		`ALTER TABLE repos ADD CONSTRAINT repos_provider_name_branch_tag_pattern_key UNIQUE (provider, name, branch, tag_pattern);`,
+		`ALTER TABLE deploys ADD COLUMN tag text NOT NULL DEFAULT '';`)
+	m.Add(10,
+		`ALTER TABLE repos ADD COLUMN apps text[] NOT NULL DEFAULT '{}';`,
+		`UPDATE repos SET apps = ARRAY[app];`,
+		`ALTER TABLE repos ALTER COLUMN apps DROP DEFAULT;`,
+		`ALTER TABLE repos ADD CONSTRAINT repos_apps_check CHECK (cardinality(apps) > 0);`,
+		`ALTER TABLE repos DROP COLUMN app;`)
+	m.Add(11,
+		`ALTER TABLE repos ADD COLUMN include_paths text[] NOT NULL DEFAULT '{}';`,
+		`ALTER TABLE repos ADD COLUMN exclude_paths text[] NOT NULL DEFAULT '{}';`,
+		`ALTER TABLE repos ADD COLUMN build_context text NOT NULL DEFAULT '';`,
+		`ALTER TABLE deploys ADD COLUMN build_context text NOT NULL DEFAULT '';`,
+		// monorepos have a repo per subtree, all deploying the same
+		// branch
+		`ALTER TABLE repos DROP CONSTRAINT repos_provider_name_branch_tag_pattern_key;`)
+	m.Add(12, `ALTER TABLE deploys ADD COLUMN skip_reason text NOT NULL DEFAULT '';`)
+	m.Add(13,
+		`ALTER TABLE repos ADD COLUMN preview_template text NOT NULL DEFAULT '';`,
+		`CREATE TABLE previews (
+	id serial PRIMARY KEY,
+	repo_id integer NOT NULL,
+	provider text NOT NULL,
+	repo text NOT NULL,
+	number bigint NOT NULL,
+	app text NOT NULL,
+	template text NOT NULL,
+	domain text NOT NULL DEFAULT '',
+	created_at timestamp with time zone NOT NULL DEFAULT current_timestamp,
+	CONSTRAINT previews_repo_id_number_key UNIQUE (repo_id, number)
+	);`)
+	m.Add(14, `ALTER TABLE repos ADD CONSTRAINT repos_rule_key UNIQUE (provider, name, branch, tag_pattern, include_paths, exclude_paths, build_context, preview_template);`)
+	m.Add(15, `ALTER TABLE repos ADD COLUMN app_ids text[] NOT NULL DEFAULT '{}';`)
+	m.Add(16,
+		`CREATE TABLE users (
+	id serial PRIMARY KEY,
+	username text NOT NULL UNIQUE,
+	password_hash bytea NOT NULL,
+	created_at timestamp with time zone NOT NULL DEFAULT current_timestamp
+	);`,
+		`CREATE TABLE sessions (
+	id text PRIMARY KEY,
+	user_id integer NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	expires_at timestamp with time zone NOT NULL,
+	created_at timestamp with time zone NOT NULL DEFAULT current_timestamp
+	);`)
+	m.Add(17,
+		`CREATE TABLE api_tokens (
+	id serial PRIMARY KEY,
+	name text NOT NULL,
+	token_hash text NOT NULL UNIQUE,
+	scopes text[] NOT NULL,
+	apps text[] NOT NULL DEFAULT '{}',
+	user_id integer REFERENCES users (id) ON DELETE SET NULL,
+	created_at timestamp with time zone NOT NULL DEFAULT current_timestamp,
+	last_used_at timestamp with time zone,
+	revoked_at timestamp with time zone
+	);`)
+	m.Add(18,
+		`ALTER TABLE users ADD COLUMN admin boolean NOT NULL DEFAULT false;`,
+		// existing users could already do everything
+		`UPDATE users SET admin = true;`,
+		`CREATE TABLE teams (
+	id serial PRIMARY KEY,
+	name text NOT NULL UNIQUE,
+	created_at timestamp with time zone NOT NULL DEFAULT current_timestamp
+	);`,
+		`CREATE TABLE team_members (
+	team_id integer NOT NULL REFERENCES teams (id) ON DELETE CASCADE,
+	user_id integer NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	PRIMARY KEY (team_id, user_id)
+	);`,
+		`CREATE TABLE role_bindings (
+	id serial PRIMARY KEY,
+	user_id integer REFERENCES users (id) ON DELETE CASCADE,
+	team_id integer REFERENCES teams (id) ON DELETE CASCADE,
+	role text NOT NULL,
+	app text NOT NULL DEFAULT '',
+	label text NOT NULL DEFAULT '',
+	created_at timestamp with time zone NOT NULL DEFAULT current_timestamp,
+	CHECK ((user_id IS NULL) <> (team_id IS NULL)),
+	CHECK ((app = '') <> (label = ''))
+	);`)
+	m.Add(19,
+		`CREATE TABLE audit_events (
+	id bigserial PRIMARY KEY,
+	action text NOT NULL,
+	actor text NOT NULL,
+	user_id integer,
+	token_id integer,
+	ip text NOT NULL,
+	apps text[] NOT NULL DEFAULT '{}',
+	repo_id integer,
+	details jsonb NOT NULL DEFAULT '{}',
+	created_at timestamp with time zone NOT NULL DEFAULT current_timestamp
+	);`,
+		`CREATE INDEX audit_events_created_at_idx ON audit_events (created_at);`,
+		`CREATE INDEX audit_events_apps_idx ON audit_events USING gin (apps);`,
+		// audit events are append-only
+		`CREATE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+BEGIN
+	RAISE EXCEPTION 'audit events cannot be changed or deleted';
+END;
+$$ LANGUAGE plpgsql;`,
+		`CREATE TRIGGER audit_events_append_only BEFORE UPDATE OR DELETE ON audit_events
+	FOR EACH ROW EXECUTE PROCEDURE audit_events_append_only();`,
+		`CREATE TRIGGER audit_events_no_truncate BEFORE TRUNCATE ON audit_events
+	FOR EACH STATEMENT EXECUTE PROCEDURE audit_events_append_only();`)
 	return m.Migrate(db)
 }
 
@@ -79,14 +291,58 @@ func newControllerClient() (controller.Client, error) {
 }
 
 func NewServer(db *postgres.DB, client controller.Client, secretToken []byte) *Server {
-	s := &Server{db: db, client: client, secretToken: secretToken}
+	s := &Server{
+		db:          db,
+		client:      client,
+		secretToken: secretToken,
+		workerID:    random.UUID(),
+		deployCh:    make(chan struct{}, 1),
+		logBroker:   newDeployLogBroker(),
+		dedupWindow: defaultDedupWindow,
+
+		deliveryRetention: defaultDeliveryRetention,
+	}
 	s.router = httprouter.New()
 	s.router.POST("/", s.webhook)
-	s.router.GET("/", s.index)
-	s.router.GET("/repos.json", s.getRepos)
-	s.router.POST("/repos", s.createRepo)
-	s.router.GET("/apps.json", s.getApps)
+	s.router.GET("/", scoped("", s.index))
+	s.router.GET("/login", s.loginPage)
+	s.router.POST("/login", s.login)
+	s.router.POST("/logout", scoped("", s.logout))
+	s.router.GET("/repos.json", scoped(ScopeReposRead, s.getRepos))
+	s.router.POST("/repos", scoped(ScopeReposWrite, s.createRepo))
+	s.router.GET("/repos/:id", scoped(ScopeReposRead, s.getRepo))
+	s.router.PUT("/repos/:id", scoped(ScopeReposWrite, s.updateRepo))
+	s.router.PATCH("/repos/:id", scoped(ScopeReposWrite, s.updateRepo))
+	s.router.DELETE("/repos/:id", scoped(ScopeReposWrite, s.deleteRepo))
+	s.router.GET("/repos/:id/deploys.json", scoped(ScopeDeploysRead, s.getRepoDeploys))
+	s.router.POST("/repos/:id/deploys", scoped(ScopeDeploysTrigger, s.triggerDeploy))
+	s.router.PUT("/repos/:id/secret", scoped(ScopeReposWrite, s.setRepoSecret))
+	s.router.GET("/apps.json", scoped(ScopeReposRead, s.getApps))
+	s.router.GET("/deploys.json", scoped(ScopeDeploysRead, s.getDeploys))
+	s.router.GET("/deploys/:id/log", scoped(ScopeDeploysRead, s.getDeployLog))
+	s.router.POST("/deploys/:id/rollback", scoped(ScopeDeploysTrigger, s.rollbackDeploy))
+	s.router.GET("/deliveries", scoped(ScopeDeploysRead, s.getDeliveries))
+	s.router.GET("/deliveries/:id", scoped(ScopeDeploysRead, s.getDelivery))
+	s.router.POST("/deliveries/:id/replay", scoped(ScopeDeploysTrigger, s.replayDelivery))
+	s.router.GET("/previews.json", scoped(ScopeDeploysRead, s.getPreviews))
+	s.router.GET("/config/export", scoped(ScopeReposRead, s.exportConfig))
+	s.router.GET("/tokens.json", adminOnly(s.getAPITokens))
+	s.router.POST("/tokens", adminOnly(s.createAPIToken))
+	s.router.DELETE("/tokens/:id", adminOnly(s.revokeAPIToken))
+	s.router.GET("/users.json", adminOnly(s.getUsers))
+	s.router.POST("/users", adminOnly(s.createUser))
+	s.router.DELETE("/users/:id", adminOnly(s.deleteUser))
+	s.router.GET("/teams.json", adminOnly(s.getTeams))
+	s.router.POST("/teams", adminOnly(s.createTeam))
+	s.router.PUT("/teams/:id", adminOnly(s.updateTeam))
+	s.router.DELETE("/teams/:id", adminOnly(s.deleteTeam))
+	s.router.GET("/roles.json", adminOnly(s.getRoleBindings))
+	s.router.POST("/roles", adminOnly(s.createRoleBinding))
+	s.router.DELETE("/roles/:id", adminOnly(s.deleteRoleBinding))
+	s.router.GET("/audit.json", adminOnly(s.getAuditEvents))
 	s.router.ServeFiles("/assets/*filepath", http.Dir("assets"))
+	s.cors = s.newCORSOptions()
+	s.handler = s.cors.Handler(http.HandlerFunc(s.requireAuth))
 	return s
 
 }
@@ -96,76 +352,87 @@ type Server struct {
 	client      controller.Client
 	secretToken []byte
 	router      *httprouter.Router
-}
+	handler     http.Handler
 
-func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	s.router.ServeHTTP(w, req)
-}
+	// allowSHA1 accepts webhooks which are only signed with the legacy
+	// HMAC-SHA1 X-Hub-Signature header, for senders which do not
+	// support SHA-256
+	allowSHA1 bool
 
-func (s *Server) index(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
-	http.ServeFile(w, req, "assets/index.html")
-}
+	// requireSHA256 rejects webhooks which are only signed with SHA-1
+	// even if allowSHA1 is set
+	requireSHA256 bool
 
-type Repo struct {
-	ID        int32      `json:"id"`
-	Name      string     `json:"name"`
-	Branch    string     `json:"branch"`
-	App       string     `json:"app"`
-	CreatedAt *time.Time `json:"created_at"`
-}
+	// secretBox encrypts per-repo secrets, and is nil if REPO_SECRET_KEY
+	// is not set
+	secretBox *secretBox
+
+	// dedupWindow is how long deliveries and commits are remembered in
+	// order to ignore duplicate webhooks
+	dedupWindow time.Duration
+
+	// deliveryRetention is how long deliveries are stored before being
+	// pruned, with zero keeping them forever
+	deliveryRetention time.Duration
+
+	// skipAllCommits skips deploying a push if any of its commits
+	// contain a skip directive, rather than only the head commit
+	skipAllCommits bool
+
+	// previewDomainSuffix is the domain which preview app routes are
+	// added under, defaulting to the domain of the template app
+	previewDomainSuffix string
+
+	// behindRouter trusts the X-Forwarded-For header set by the Flynn
+	// router for the client IP address recorded in the audit log
+	behindRouter bool
 
-func scanRepo(s postgres.Scanner) (Repo, error) {
-	var r Repo
-	return r, s.Scan(&r.ID, &r.Name, &r.Branch, &r.App, &r.CreatedAt)
+	// cors are the options for cross-origin requests, which are allowed
+	// from allowedOrigins as well as the UI's own origin
+	cors           *cors.Options
+	allowedOrigins []string
+
+	// authDisabled serves requests without requiring users to log in,
+	// which is only used in tests
+	authDisabled bool
+
+	// workerID identifies the deploy worker of this process in the
+	// leases of the deploys it is running
+	workerID string
+
+	// deployCh is used to wake up the deploy worker when a new deploy
+	// is queued
+	deployCh chan struct{}
+
+	// logBroker distributes the output of running deploys to clients
+	// following their logs
+	logBroker *deployLogBroker
 }
 
-func (s *Server) getRepos(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
-	rows, err := s.db.Query("SELECT id, name, branch, app, created_at FROM repos")
-	if err != nil {
-		log.Println("error getting repos from db:", err)
-		http.Error(w, "error getting repos", 500)
-		return
-	}
-	var repos []Repo
-	for rows.Next() {
-		repo, err := scanRepo(rows)
-		if err != nil {
-			rows.Close()
-			log.Println("error scanning db row:", err)
-			http.Error(w, "error getting repos", 500)
-			return
-		}
-		repos = append(repos, repo)
-	}
-	if err := rows.Err(); err != nil {
-		log.Println("error scanning db rows:", err)
-		http.Error(w, "error getting repos", 500)
-		return
-	}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(repos)
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.handler.ServeHTTP(w, req)
 }
 
-func (s *Server) createRepo(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
-	r := Repo{
-		Name:   req.FormValue("name"),
-		Branch: req.FormValue("branch"),
-		App:    req.FormValue("app"),
-	}
-	if r.Name == "" || r.App == "" {
-		http.Error(w, "both name and app are required", 400)
+// index renders the UI, including the CSRF token of the login session in
+// forms and for AJAX requests.
+//
+// text/template is used since html/template cannot parse the underscore
+// templates in the page, which is safe since the token is hex encoded.
+func (s *Server) index(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	tmpl, err := template.ParseFiles("assets/index.html")
+	if err != nil {
+		log.Println("error parsing index template:", err)
+		http.Error(w, "error rendering index", 500)
 		return
 	}
-	if r.Branch == "" {
-		r.Branch = "master"
+	var data struct{ CSRFToken string }
+	if token := requestCaller(req).sessionToken; token != "" {
+		data.CSRFToken = csrfToken(token)
 	}
-	err := s.db.QueryRow("INSERT INTO repos (name, branch, app) VALUES ($1, $2, $3) RETURNING created_at", r.Name, r.Branch, r.App).Scan(&r.CreatedAt)
-	if err != nil {
-		log.Println("error adding repo to db:", err)
-		http.Error(w, "error adding repo", 500)
-		return
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := tmpl.Execute(w, data); err != nil {
+		log.Println("error rendering index template:", err)
 	}
-	http.Redirect(w, req, "/", 302)
 }
 
 func (s *Server) getApps(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
@@ -175,24 +442,58 @@ func (s *Server) getApps(w http.ResponseWriter, req *http.Request, _ httprouter.
 		http.Error(w, "error getting apps", 500)
 		return
 	}
+	caller := requestCaller(req)
+	visible := make([]*ct.App, 0, len(apps))
+	for _, app := range apps {
+		if caller.CanAccessApps(ScopeReposRead, app.Name) {
+			visible = append(visible, app)
+		}
+	}
+	apps = visible
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(apps)
 }
 
-func (s *Server) getRepo(name, branch string) (Repo, error) {
-	row := s.db.QueryRow("SELECT id, name, branch, app, created_at FROM repos WHERE name = $1 AND branch = $2", name, branch)
-	return scanRepo(row)
-}
-
 type Event struct {
 	Ref        string     `json:"ref"`
 	Deleted    bool       `json:"deleted"`
 	HeadCommit Commit     `json:"head_commit"`
+	Commits    []Commit   `json:"commits"`
 	Repository Repository `json:"repository"`
+
+	// Size is the number of commits pushed if the provider sends it,
+	// which is more than len(Commits) if they were truncated
+	Size int `json:"size,omitempty"`
+
+	// PullRequest is set for pull request events, with Ref set to the
+	// base branch and HeadCommit to the head of the pull request
+	PullRequest *PullRequest `json:"-"`
 }
 
 type Commit struct {
-	ID string `json:"id"`
+	ID       string       `json:"id"`
+	Message  string       `json:"message,omitempty"`
+	Author   CommitAuthor `json:"author"`
+	Added    []string     `json:"added,omitempty"`
+	Modified []string     `json:"modified,omitempty"`
+	Removed  []string     `json:"removed,omitempty"`
+}
+
+type CommitAuthor struct {
+	Name     string `json:"name,omitempty"`
+	Email    string `json:"email,omitempty"`
+	Username string `json:"username,omitempty"`
+}
+
+// findCommit returns the commit with the given ID from the list, or a
+// commit with just the ID if it is not in the list.
+func findCommit(commits []Commit, id string) Commit {
+	for _, commit := range commits {
+		if commit.ID == id {
+			return commit
+		}
+	}
+	return Commit{ID: id}
 }
 
 type Repository struct {
@@ -205,93 +506,173 @@ func (s *Server) webhook(w http.ResponseWriter, req *http.Request, _ httprouter.
 	log.Println("handling request")
 	defer req.Body.Close()
 
-	eventHeader := req.Header.Get("X-Github-Event")
-	if eventHeader == "" {
-		log.Println("request missing X-Github-Event header")
-		http.Error(w, "missing X-Github-Event header", 400)
-		return
-	}
-
-	sigHeader := req.Header.Get("X-Hub-Signature")
-	if sigHeader == "" {
-		log.Println("request missing X-Hub-Signature header")
-		http.Error(w, "missing X-Hub-Signature header", 400)
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, maxDeliveryBodySize))
+	if err != nil {
+		// reading the body only fails if it is too large or the
+		// client has gone away
+		log.Println("error reading request body:", err)
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
 		return
 	}
 
-	// read the body and check the signature is correct
-	var body bytes.Buffer
+	s.processDelivery(w, &Delivery{Header: req.Header, Body: body})
+}
 
-	mac := hmac.New(sha1.New, s.secretToken)
-	if _, err := io.Copy(io.MultiWriter(&body, mac), req.Body); err != nil {
-		log.Println("error reading request body:", err)
-		http.Error(w, "internal error", 500)
+// handleDelivery handles a webhook delivery, recording the provider and
+// event type, the result of authenticating the request and the ID of any
+// queued deploy in d.
+//
+// Replayed deliveries have already been authenticated when they were first
+// received (with d.RepoIDs set to the repo rules which authenticated them),
+// and are deployed even if they duplicate a previous deploy. They
+// use the provider and event type recorded when they were first received
+// since secret headers (e.g. the generic provider's bearer token) are
+// redacted when deliveries are stored.
+func (s *Server) handleDelivery(w http.ResponseWriter, d *Delivery) {
+	provider, eventType := s.findProvider(d.Header)
+	if d.ReplayOf != nil {
+		provider, eventType = s.provider(d.Provider), d.Event
+	}
+	if provider == nil {
+		log.Println("request missing event header")
+		http.Error(w, "unknown webhook provider: missing event header", 400)
 		return
 	}
-	sig := fmt.Sprintf("sha1=%x", mac.Sum(nil))
+	d.Provider = provider.Name()
+	d.Event = eventType
+	d.DeliveryID = provider.DeliveryID(d.Header)
+
+	replay := d.ReplayOf != nil
+	if !replay {
+		// look up the secrets of each rule of the repo which sent the
+		// webhook, which are then used to authenticate the request
+		name := provider.RepoName(d.Body)
+		rules, err := s.getRepoSecrets(provider.Name(), name)
+		if err != nil {
+			log.Printf("error loading secrets for repo %q: %s\n", name, err)
+			http.Error(w, "internal error", 500)
+			return
+		}
 
-	if !hmac.Equal([]byte(sig), []byte(sigHeader)) {
-		log.Println("invalid X-Hub-Signature header")
-		http.Error(w, "invalid X-Hub-Signature header", 400)
-		return
+		for _, rule := range rules {
+			if err = provider.Authenticate(d.Header, d.Body, rule.Secrets); err == nil {
+				d.RepoIDs = append(d.RepoIDs, rule.RepoID)
+			}
+		}
+		if len(d.RepoIDs) == 0 {
+			log.Println(err)
+			http.Error(w, err.Error(), 400)
+			return
+		}
 	}
+	d.SignatureValid = true
 
-	switch eventHeader {
-	case "ping":
-		log.Println("received ping event")
+	events, err := provider.Events(eventType, d.Body)
+	if err == errPing {
+		log.Printf("received %s ping event\n", provider.Name())
 		fmt.Fprintln(w, "pong")
 		return
-	case "push":
-		log.Println("received push event")
-	default:
-		log.Println("received unknown event:", eventHeader)
-		http.Error(w, "unknown X-Github-Event: "+eventHeader, 400)
+	} else if err != nil {
+		log.Printf("error handling %s %q event: %s\n", provider.Name(), eventType, err)
+		http.Error(w, err.Error(), 400)
 		return
 	}
+	log.Printf("received %s %q event\n", provider.Name(), eventType)
 
-	var event Event
-	if err := json.NewDecoder(&body).Decode(&event); err != nil {
-		log.Println("error decoding JSON:", err)
-		http.Error(w, "invalid JSON payload", 400)
-		return
+	for _, event := range events {
+		s.handleEvent(w, d, provider, event)
 	}
+}
 
+// handleEvent queues a deploy of the push event to each app of the matching
+// repo rules, writing the outcome to the response.
+func (s *Server) handleEvent(w http.ResponseWriter, d *Delivery, provider Provider, event *Event) {
 	if event.Deleted {
-		log.Println("skipping deleted branch:", event.Ref)
+		log.Println("skipping deleted ref:", event.Ref)
+		return
+	}
+	if event.PullRequest != nil {
+		s.handlePullRequest(w, d, provider, event)
 		return
 	}
 
-	branch := path.Base(event.Ref)
-	repo, err := s.getRepo(event.Repository.FullName, branch)
+	ref, ok := parseRef(event.Ref)
+	if !ok {
+		log.Println("skipping unsupported ref:", event.Ref)
+		return
+	}
+	repos, err := s.matchRepos(provider.Name(), event.Repository.FullName, ref, changedFiles(event))
 	if err != nil {
-		log.Printf("error loading repo %q (%q branch): %s\n", event.Repository.FullName, branch, err)
+		log.Printf("error loading repos %q (%s): %s\n", event.Repository.FullName, ref, err)
+		http.Error(w, "error loading repos", 500)
 		return
 	}
-
-	go s.deploy(repo.App, event.Repository.CloneURL, branch, event.HeadCommit.ID)
+	repos = d.authenticatedRepos(repos)
+	if len(repos) == 0 {
+		log.Printf("no repos match %q (%s)\n", event.Repository.FullName, ref)
+		return
+	}
+	for _, repo := range repos {
+		for _, app := range repo.Apps {
+			s.queueEventDeploy(w, d, repo, app, ref, event, d.ReplayOf == nil)
+		}
+	}
 }
 
-func (s *Server) deploy(app, url, branch, commit string) {
-	log.Printf("deploying app: %s, url: %s, branch: %s, commit: %s\n", app, url, branch, commit)
-
-	taffyRelease, err := s.client.GetAppRelease("taffy")
+// queueEventDeploy queues a deploy of the event to the app for the repo
+// rule, writing the outcome to the response. If dedup is set, the deploy is
+// skipped if it duplicates a recent deploy.
+func (s *Server) queueEventDeploy(w http.ResponseWriter, d *Delivery, repo Repo, app string, ref Ref, event *Event, dedup bool) {
+	deploy := &Deploy{
+		RepoID:       repo.ID,
+		Provider:     repo.Provider,
+		Repo:         repo.Name,
+		CloneURL:     event.Repository.CloneURL,
+		App:          app,
+		Commit:       event.HeadCommit.ID,
+		BuildContext: repo.BuildContext,
+		SkipReason:   skipReason(event, s.skipAllCommits),
+		DeliveryID:   d.DeliveryID,
+	}
+	if ref.Type == RefTypeTag {
+		deploy.Tag = ref.Name
+	} else {
+		deploy.Branch = ref.Name
+	}
+	if deploy.SkipReason != "" {
+		// record the skipped deploy so it appears in the deploy
+		// history
+		deploy.State = DeployStateSkipped
+	}
+	var dup *Deploy
+	var err error
+	switch {
+	case d.tx != nil:
+		// the deploy worker is woken up once the transaction has
+		// been committed
+		err = queueDeployTx(d.tx, deploy)
+	case dedup:
+		dup, err = s.queueDeployUnlessDuplicate(deploy)
+	default:
+		err = s.queueDeploy(deploy)
+	}
 	if err != nil {
-		log.Println("error getting taffy release:", err)
+		log.Println("error queueing deploy:", err)
+		http.Error(w, "error queueing deploy", 500)
 		return
 	}
-
-	rwc, err := s.client.RunJobAttached("taffy", &ct.NewJob{
-		ReleaseID:  taffyRelease.ID,
-		ReleaseEnv: true,
-		Args:       []string{"/bin/taffy", app, url, branch, commit},
-	})
-	attachClient := cluster.NewAttachClient(rwc)
-	exit, err := attachClient.Receive(os.Stdout, os.Stderr)
-	if err != nil {
-		log.Println("error running job:", err)
-	} else if exit != 0 {
-		log.Println("unexpected exit status:", exit)
-	} else {
-		log.Println("deploy complete")
+	if dup != nil {
+		log.Printf("skipping duplicate of deploy %d (delivery %q, commit %s)\n", dup.ID, deploy.DeliveryID, deploy.Commit)
+		fmt.Fprintf(w, "duplicate of deploy %d\n", dup.ID)
+		return
+	}
+	if d.DeployID == nil {
+		d.DeployID = &deploy.ID
+	}
+	if deploy.State == DeployStateSkipped {
+		log.Printf("skipping deploy %d: %s\n", deploy.ID, deploy.SkipReason)
+		fmt.Fprintf(w, "deploy %d skipped: %s\n", deploy.ID, deploy.SkipReason)
+		return
 	}
+	fmt.Fprintf(w, "deploy %d queued\n", deploy.ID)
 }
@@ -2,13 +2,20 @@ package main
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
+	"hash"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 
+	"github.com/flynn/flynn/controller/client"
 	"github.com/flynn/flynn/pkg/postgres"
 	"github.com/jackc/pgx"
 )
@@ -42,6 +49,13 @@ func setupTestDB(dbname string) (*postgres.DB, error) {
 	return d, setupDB(d)
 }
 
+// newTestServer returns a server which does not require users to log in
+func newTestServer(db *postgres.DB, client controller.Client, secretToken []byte) *Server {
+	s := NewServer(db, client, secretToken)
+	s.authDisabled = true
+	return s
+}
+
 // TestCreateRepo tests that repos can be created via the HTTP API
 func TestCreateRepo(t *testing.T) {
 	db, err := setupTestDB("flynn_webhook_test")
@@ -50,7 +64,7 @@ func TestCreateRepo(t *testing.T) {
 	}
 	defer db.Close()
 
-	s := httptest.NewServer(NewServer(db, nil, nil))
+	s := httptest.NewServer(newTestServer(db, newFakeAppClient("foo"), nil))
 	defer s.Close()
 
 	data := bytes.NewBuffer([]byte("name=lmars/foo&branch=master&app=foo"))
@@ -85,7 +99,602 @@ func TestCreateRepo(t *testing.T) {
 	if repo.Branch != "master" {
 		t.Fatalf(`expected repo branch "master", got %q`, repo.Branch)
 	}
-	if repo.App != "foo" {
-		t.Fatalf(`expected repo app "master", got %q`, repo.App)
+	if len(repo.Apps) != 1 || repo.Apps[0] != "foo" {
+		t.Fatalf(`expected repo apps ["foo"], got %q`, repo.Apps)
+	}
+}
+
+// signBody returns the HMAC of the body using the given hash and secret
+// token, formatted like a GitHub signature header
+func signBody(body []byte, prefix string, hash func() hash.Hash, secretToken []byte) string {
+	mac := hmac.New(hash, secretToken)
+	mac.Write(body)
+	return fmt.Sprintf("%s%x", prefix, mac.Sum(nil))
+}
+
+// newWebhookRequest returns a GitHub webhook request for the given URL,
+// signed with the given secret token using both signature headers like
+// GitHub does
+func newWebhookRequest(url, event string, payload interface{}, secretToken []byte) (*http.Request, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Github-Event", event)
+	req.Header.Set("X-Hub-Signature", signBody(data, "sha1=", sha1.New, secretToken))
+	req.Header.Set("X-Hub-Signature-256", signBody(data, "sha256=", sha256.New, secretToken))
+	return req, nil
+}
+
+// sendWebhook sends a GitHub webhook request to the given URL
+func sendWebhook(url, event string, payload interface{}, secretToken []byte) (*http.Response, error) {
+	req, err := newWebhookRequest(url, event, payload, secretToken)
+	if err != nil {
+		return nil, err
+	}
+	return http.DefaultClient.Do(req)
+}
+
+// TestWebhookSignature tests that webhooks are authenticated using the
+// SHA-256 signature, falling back to the SHA-1 signature only if SHA-1
+// signatures are allowed and SHA-256 signatures are not required
+func TestWebhookSignature(t *testing.T) {
+	secretToken := []byte("secret")
+	body := []byte(`{"zen":"Keep it logically awesome."}`)
+	sha1Sig := signBody(body, "sha1=", sha1.New, secretToken)
+	sha256Sig := signBody(body, "sha256=", sha256.New, secretToken)
+	invalidSHA1Sig := signBody(body, "sha1=", sha1.New, []byte("invalid"))
+	invalidSHA256Sig := signBody(body, "sha256=", sha256.New, []byte("invalid"))
+
+	for _, test := range []struct {
+		desc          string
+		sha1          string
+		sha256        string
+		allowSHA1     bool
+		requireSHA256 bool
+		valid         bool
+	}{
+		{desc: "both signatures", sha1: sha1Sig, sha256: sha256Sig, valid: true},
+		{desc: "SHA-256 only", sha256: sha256Sig, valid: true},
+		{desc: "SHA-1 only", sha1: sha1Sig},
+		{desc: "no signatures"},
+		{desc: "invalid SHA-256 with valid SHA-1", sha1: sha1Sig, sha256: invalidSHA256Sig},
+		{desc: "allowed with both signatures", sha1: sha1Sig, sha256: sha256Sig, allowSHA1: true, valid: true},
+		{desc: "allowed with SHA-256 only", sha256: sha256Sig, allowSHA1: true, valid: true},
+		{desc: "allowed with SHA-1 only", sha1: sha1Sig, allowSHA1: true, valid: true},
+		{desc: "allowed with invalid SHA-1", sha1: invalidSHA1Sig, allowSHA1: true},
+		{desc: "allowed with invalid SHA-256 and valid SHA-1", sha1: sha1Sig, sha256: invalidSHA256Sig, allowSHA1: true},
+		{desc: "strict with both signatures", sha1: sha1Sig, sha256: sha256Sig, allowSHA1: true, requireSHA256: true, valid: true},
+		{desc: "strict with SHA-256 only", sha256: sha256Sig, allowSHA1: true, requireSHA256: true, valid: true},
+		{desc: "strict with SHA-1 only", sha1: sha1Sig, allowSHA1: true, requireSHA256: true},
+	} {
+		h := make(http.Header)
+		if test.sha1 != "" {
+			h.Set("X-Hub-Signature", test.sha1)
+		}
+		if test.sha256 != "" {
+			h.Set("X-Hub-Signature-256", test.sha256)
+		}
+		s := NewServer(nil, nil, nil)
+		s.allowSHA1 = test.allowSHA1
+		s.requireSHA256 = test.requireSHA256
+		provider := s.provider("github")
+		err := provider.Authenticate(h, body, [][]byte{secretToken})
+		if test.valid && err != nil {
+			t.Fatalf("%s: expected valid signature, got error: %s", test.desc, err)
+		} else if !test.valid && err == nil {
+			t.Fatalf("%s: expected invalid signature", test.desc)
+		}
+	}
+
+	// check that any of the given secrets can be used
+	if err := checkSignature(http.Header{"X-Hub-Signature-256": {sha256Sig}}, body, [][]byte{[]byte("other"), secretToken}, false); err != nil {
+		t.Fatalf("expected signature using second secret to be valid, got error: %s", err)
+	}
+}
+
+// TestWebhookQueuesDeploy tests that push events are added to the deploy
+// queue
+func TestWebhookQueuesDeploy(t *testing.T) {
+	db, err := setupTestDB("flynn_webhook_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	secretToken := []byte("secret")
+	s := httptest.NewServer(newTestServer(db, nil, secretToken))
+	defer s.Close()
+
+	if err := db.Exec("INSERT INTO repos (name, branch, apps) VALUES ('lmars/foo', 'master', '{foo}')"); err != nil {
+		t.Fatal(err)
+	}
+
+	event := Event{
+		Ref:        "refs/heads/master",
+		HeadCommit: Commit{ID: "a1b2c3"},
+		Repository: Repository{FullName: "lmars/foo", CloneURL: "https://github.com/lmars/foo.git"},
+	}
+	res, err := sendWebhook(s.URL, "push", event, secretToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected ok response, got %s", res.Status)
+	}
+
+	deploy, err := scanDeploy(db.QueryRow("SELECT " + deployColumns + " FROM deploys"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deploy.State != DeployStatePending {
+		t.Fatalf("expected deploy state %q, got %q", DeployStatePending, deploy.State)
+	}
+	if deploy.App != "foo" {
+		t.Fatalf(`expected deploy app "foo", got %q`, deploy.App)
+	}
+	if deploy.Commit != "a1b2c3" {
+		t.Fatalf(`expected deploy commit "a1b2c3", got %q`, deploy.Commit)
+	}
+}
+
+// TestWebhookDeduplication tests that redelivered webhooks and pushes of a
+// commit which was recently deployed do not queue another deploy
+func TestWebhookDeduplication(t *testing.T) {
+	db, err := setupTestDB("flynn_webhook_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	secretToken := []byte("secret")
+	s := httptest.NewServer(newTestServer(db, nil, secretToken))
+	defer s.Close()
+
+	if err := db.Exec("INSERT INTO repos (name, branch, apps) VALUES ('lmars/foo', 'master', '{foo}')"); err != nil {
+		t.Fatal(err)
+	}
+
+	push := func(delivery, commit string) string {
+		event := Event{
+			Ref:        "refs/heads/master",
+			HeadCommit: Commit{ID: commit},
+			Repository: Repository{FullName: "lmars/foo", CloneURL: "https://github.com/lmars/foo.git"},
+		}
+		req, err := newWebhookRequest(s.URL, "push", event, secretToken)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-GitHub-Delivery", delivery)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("expected ok response, got %s", res.Status)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(body)
+	}
+
+	for _, test := range []struct {
+		delivery  string
+		commit    string
+		duplicate bool
+	}{
+		{delivery: "delivery-1", commit: "a1", duplicate: false},
+		{delivery: "delivery-1", commit: "a1", duplicate: true},
+		{delivery: "delivery-2", commit: "a1", duplicate: true},
+		{delivery: "delivery-1", commit: "a2", duplicate: true},
+		{delivery: "delivery-3", commit: "a2", duplicate: false},
+	} {
+		body := push(test.delivery, test.commit)
+		if duplicate := strings.HasPrefix(body, "duplicate"); duplicate != test.duplicate {
+			t.Fatalf("expected duplicate=%t for delivery %s of commit %s, got body %q", test.duplicate, test.delivery, test.commit, body)
+		}
+	}
+
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM deploys").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Fatalf("expected 2 deploys, got %d", count)
+	}
+
+	// concurrent redeliveries only queue one deploy
+	event := Event{
+		Ref:        "refs/heads/master",
+		HeadCommit: Commit{ID: "a3"},
+		Repository: Repository{FullName: "lmars/foo", CloneURL: "https://github.com/lmars/foo.git"},
+	}
+	errs := make(chan error)
+	for i := 0; i < 5; i++ {
+		go func() {
+			req, err := newWebhookRequest(s.URL, "push", event, secretToken)
+			if err != nil {
+				errs <- err
+				return
+			}
+			req.Header.Set("X-GitHub-Delivery", "delivery-4")
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				errs <- err
+				return
+			}
+			res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				err = fmt.Errorf("expected ok response, got %s", res.Status)
+			}
+			errs <- err
+		}()
+	}
+	for i := 0; i < 5; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.QueryRow("SELECT COUNT(*) FROM deploys").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Fatalf("expected 3 deploys after concurrent redeliveries, got %d", count)
+	}
+}
+
+// TestGithubReleaseEvents tests that published GitHub releases are
+// converted to tag push events
+func TestGithubReleaseEvents(t *testing.T) {
+	p := githubProvider{}
+	events, err := p.Events("release", []byte(`{"action":"published","release":{"tag_name":"v1.2.0"},"repository":{"full_name":"lmars/foo"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(events))
+	}
+	if events[0].Ref != "refs/tags/v1.2.0" || events[0].HeadCommit.ID != "v1.2.0" || events[0].Repository.FullName != "lmars/foo" {
+		t.Fatalf("unexpected event: %+v", events[0])
+	}
+
+	events, err = p.Events("release", []byte(`{"action":"created","release":{"tag_name":"v1.2.0"},"repository":{"full_name":"lmars/foo"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 0 {
+		t.Fatalf("expected no events for unpublished release, got %d", len(events))
+	}
+}
+
+// TestWebhookTagDeploy tests that tag pushes are deployed by repos with a
+// matching tag pattern rather than being treated as branches
+func TestWebhookTagDeploy(t *testing.T) {
+	db, err := setupTestDB("flynn_webhook_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	secretToken := []byte("secret")
+	s := httptest.NewServer(newTestServer(db, nil, secretToken))
+	defer s.Close()
+
+	if err := db.Exec("INSERT INTO repos (name, branch, apps) VALUES ('lmars/foo', 'master', '{foo-staging}')"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec("INSERT INTO repos (name, branch, tag_pattern, apps) VALUES ('lmars/foo', '', 'v*', '{foo-production}')"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ref := range []string{"refs/tags/master", "refs/tags/release-1", "refs/heads/feature/master", "refs/tags/v1.2.0", "refs/heads/master"} {
+		event := Event{
+			Ref:        ref,
+			HeadCommit: Commit{ID: "a1b2c3"},
+			Repository: Repository{FullName: "lmars/foo", CloneURL: "https://github.com/lmars/foo.git"},
+		}
+		res, err := sendWebhook(s.URL, "push", event, secretToken)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("expected ok response, got %s", res.Status)
+		}
+	}
+
+	rows, err := db.Query("SELECT " + deployColumns + " FROM deploys ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var deploys []*Deploy
+	for rows.Next() {
+		deploy, err := scanDeploy(rows)
+		if err != nil {
+			t.Fatal(err)
+		}
+		deploys = append(deploys, deploy)
+	}
+	if len(deploys) != 2 {
+		t.Fatalf("expected 2 deploys, got %d", len(deploys))
+	}
+	if d := deploys[0]; d.App != "foo-production" || d.Tag != "v1.2.0" || d.Branch != "" {
+		t.Fatalf("unexpected tag deploy: %+v", d)
+	}
+	if d := deploys[1]; d.App != "foo-staging" || d.Branch != "master" || d.Tag != "" {
+		t.Fatalf("unexpected branch deploy: %+v", d)
+	}
+}
+
+// TestWebhookBranchPatterns tests that pushes deploy each app of the repos
+// whose branch pattern matches, using the most specific repo for each app
+func TestWebhookBranchPatterns(t *testing.T) {
+	db, err := setupTestDB("flynn_webhook_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	secretToken := []byte("secret")
+	s := httptest.NewServer(newTestServer(db, nil, secretToken))
+	defer s.Close()
+
+	for _, repo := range []struct {
+		branch string
+		apps   []string
+	}{
+		{"/release.*/", []string{"foo-release"}},
+		{"release/*", []string{"foo-release", "foo-staging"}},
+		{"release/1.0", []string{"foo-release"}},
+		{"/feature-.*/", []string{"foo-preview"}},
+	} {
+		if err := db.Exec("INSERT INTO repos (name, branch, apps) VALUES ('lmars/foo', $1, $2)", repo.branch, repo.apps); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		branch string
+		repos  map[string]int32
+	}{
+		{"release/1.0", map[string]int32{"foo-release": 3, "foo-staging": 2}},
+		{"release/2.0", map[string]int32{"foo-release": 2, "foo-staging": 2}},
+		{"release-3", map[string]int32{"foo-release": 1}},
+		{"feature-bar", map[string]int32{"foo-preview": 4}},
+		{"master", map[string]int32{}},
+	} {
+		if err := db.Exec("DELETE FROM deploys"); err != nil {
+			t.Fatal(err)
+		}
+		event := Event{
+			Ref:        "refs/heads/" + test.branch,
+			HeadCommit: Commit{ID: "a1b2c3"},
+			Repository: Repository{FullName: "lmars/foo", CloneURL: "https://github.com/lmars/foo.git"},
+		}
+		res, err := sendWebhook(s.URL, "push", event, secretToken)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("expected ok response, got %s", res.Status)
+		}
+
+		rows, err := db.Query("SELECT " + deployColumns + " FROM deploys")
+		if err != nil {
+			t.Fatal(err)
+		}
+		repos := make(map[string]int32)
+		for rows.Next() {
+			deploy, err := scanDeploy(rows)
+			if err != nil {
+				rows.Close()
+				t.Fatal(err)
+			}
+			if deploy.Branch != test.branch {
+				t.Fatalf("expected deploy of branch %q, got %q", test.branch, deploy.Branch)
+			}
+			repos[deploy.App] = deploy.RepoID
+		}
+		rows.Close()
+		if len(repos) != len(test.repos) {
+			t.Fatalf("%s: expected deploys %v, got %v", test.branch, test.repos, repos)
+		}
+		for app, id := range test.repos {
+			if repos[app] != id {
+				t.Fatalf("%s: expected deploys %v, got %v", test.branch, test.repos, repos)
+			}
+		}
+	}
+}
+
+// TestWebhookMultipleApps tests that a push to a repo with several apps
+// queues a separate deploy for each app
+func TestWebhookMultipleApps(t *testing.T) {
+	db, err := setupTestDB("flynn_webhook_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	secretToken := []byte("secret")
+	s := httptest.NewServer(newTestServer(db, newFakeAppClient("foo-web", "foo-worker"), secretToken))
+	defer s.Close()
+
+	data := strings.NewReader("name=lmars/foo&branch=master&app=foo-web&app=foo-worker&app=foo-web")
+	res, err := http.Post(s.URL+"/repos", "application/x-www-form-urlencoded", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected ok response, got %s", res.Status)
+	}
+
+	event := Event{
+		Ref:        "refs/heads/master",
+		HeadCommit: Commit{ID: "a1b2c3"},
+		Repository: Repository{FullName: "lmars/foo", CloneURL: "https://github.com/lmars/foo.git"},
+	}
+	req, err := newWebhookRequest(s.URL, "push", event, secretToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-GitHub-Delivery", "delivery-1")
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected ok response, got %s", res.Status)
+	}
+
+	var apps []string
+	if err := db.QueryRow("SELECT array_agg(app ORDER BY app) FROM deploys").Scan(&apps); err != nil {
+		t.Fatal(err)
+	}
+	if len(apps) != 2 || apps[0] != "foo-web" || apps[1] != "foo-worker" {
+		t.Fatalf(`expected deploys of "foo-web" and "foo-worker", got %v`, apps)
+	}
+}
+
+// TestWebhookPathFilters tests that pushes to a monorepo only deploy the
+// apps whose paths changed
+func TestWebhookPathFilters(t *testing.T) {
+	db, err := setupTestDB("flynn_webhook_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	secretToken := []byte("secret")
+	s := httptest.NewServer(newTestServer(db, newFakeAppClient("api", "web"), secretToken))
+	defer s.Close()
+
+	for _, form := range []string{
+		"name=lmars/foo&app=api&include_paths=services/api%0Alib",
+		"name=lmars/foo&app=web&include_paths=services/web&exclude_paths=services/*/docs",
+	} {
+		res, err := http.Post(s.URL+"/repos", "application/x-www-form-urlencoded", strings.NewReader(form))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("expected ok response, got %s", res.Status)
+		}
+	}
+
+	for i, test := range []struct {
+		commits []Commit
+		size    int
+		apps    string
+	}{
+		{
+			commits: []Commit{{ID: "a1", Modified: []string{"services/api/main.go"}}},
+			apps:    "[api]",
+		},
+		{
+			commits: []Commit{{ID: "a2", Added: []string{"services/web/index.html"}}, {ID: "a3", Removed: []string{"lib/util.go"}}},
+			apps:    "[api web]",
+		},
+		{
+			commits: []Commit{{ID: "a4", Modified: []string{"services/web/docs/index.md", "README.md"}}},
+			apps:    "[]",
+		},
+		{
+			// the push has commits which are not in the payload, so
+			// may have changed files of either app
+			commits: []Commit{{ID: "a5", Modified: []string{"README.md"}}},
+			size:    25,
+			apps:    "[api web]",
+		},
+	} {
+		if err := db.Exec("DELETE FROM deploys"); err != nil {
+			t.Fatal(err)
+		}
+		event := Event{
+			Ref:        "refs/heads/master",
+			HeadCommit: test.commits[len(test.commits)-1],
+			Commits:    test.commits,
+			Size:       test.size,
+			Repository: Repository{FullName: "lmars/foo", CloneURL: "https://github.com/lmars/foo.git"},
+		}
+		res, err := sendWebhook(s.URL, "push", event, secretToken)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("expected ok response, got %s", res.Status)
+		}
+
+		var apps []string
+		if err := db.QueryRow("SELECT coalesce(array_agg(app ORDER BY app), '{}') FROM deploys").Scan(&apps); err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(apps) != test.apps {
+			t.Fatalf("push %d: expected deploys to %s, got %v", i, test.apps, apps)
+		}
+	}
+}
+
+// TestWebhookSkipDirective tests that pushes with a skip directive are
+// recorded as skipped deploys rather than being queued
+func TestWebhookSkipDirective(t *testing.T) {
+	db, err := setupTestDB("flynn_webhook_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	secretToken := []byte("secret")
+	s := httptest.NewServer(newTestServer(db, nil, secretToken))
+	defer s.Close()
+
+	if err := db.Exec("INSERT INTO repos (name, branch, apps) VALUES ('lmars/foo', 'master', '{foo}')"); err != nil {
+		t.Fatal(err)
+	}
+
+	event := Event{
+		Ref:        "refs/heads/master",
+		HeadCommit: Commit{ID: "a1b2c3d4e5", Message: "Update README [skip deploy]"},
+		Repository: Repository{FullName: "lmars/foo", CloneURL: "https://github.com/lmars/foo.git"},
+	}
+	res, err := sendWebhook(s.URL, "push", event, secretToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected ok response, got %s", res.Status)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(body), "skipped") {
+		t.Fatalf("expected skipped response, got %q", body)
+	}
+
+	deploy, err := scanDeploy(db.QueryRow("SELECT " + deployColumns + " FROM deploys"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deploy.State != DeployStateSkipped {
+		t.Fatalf("expected deploy state %q, got %q", DeployStateSkipped, deploy.State)
+	}
+	if deploy.SkipReason != "commit a1b2c3d contains [skip deploy]" {
+		t.Fatalf("unexpected skip reason: %q", deploy.SkipReason)
 	}
 }